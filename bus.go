@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sync"
+)
+
+// tagEvent tells open windows that the tags of some messages have changed
+type tagEvent struct {
+	MessageIDs []string
+	ThreadIDs  []string
+}
+
+// hasThread returns true if the thread with the given ID is affected by e
+func (e tagEvent) hasThread(id string) bool {
+	for _, t := range e.ThreadIDs {
+		if t == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasMessage returns true if the message with the given ID is affected by e
+func (e tagEvent) hasMessage(id string) bool {
+	for _, m := range e.MessageIDs {
+		if m == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dbChanged tells open windows that the notmuch database was modified, e.g. by `notmuch new`
+type dbChanged struct{}
+
+// messageWindowEvent tells open windows that the window of a message was opened or closed
+type messageWindowEvent struct {
+	MessageID string
+	ThreadID  string
+}
+
+// focusEvent asks the window of the thread with the given ID to set dot on the line of a message
+type focusEvent struct {
+	ThreadID  string
+	MessageID string
+}
+
+// subscription receives the events (tagEvent, dbChanged, ...) published on the bus until it is cancelled. Events
+// are received in the order they were published.
+type subscription struct {
+	C     chan interface{}
+	queue chan interface{}
+	done  chan struct{}
+}
+
+// _subscriptionQueue is the size of the buffer between the bus and the goroutine delivering events to a subscriber
+const _subscriptionQueue = 16
+
+// forward delivers the events that were published for s to s.C, one after the other. Events that the subscriber
+// hasn't received yet are kept, so that publishing never waits for a subscriber.
+func (s *subscription) forward() {
+	var pending []interface{}
+
+	for {
+		var (
+			out  chan interface{}
+			next interface{}
+		)
+
+		if len(pending) != 0 {
+			out = s.C
+			next = pending[0]
+		}
+
+		select {
+		case e := <-s.queue:
+			pending = append(pending, e)
+		case out <- next:
+			pending = pending[1:]
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// bus passes events between windows. Each window runs in its own goroutine and subscribes to the bus, so that it
+// can update its content when something it shows changes.
+type bus struct {
+	mu   sync.Mutex
+	subs map[*subscription]bool
+}
+
+var _bus = &bus{}
+
+func (b *bus) subscribe() *subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subs == nil {
+		b.subs = make(map[*subscription]bool)
+	}
+
+	s := &subscription{
+		C:     make(chan interface{}),
+		queue: make(chan interface{}, _subscriptionQueue),
+		done:  make(chan struct{}),
+	}
+
+	b.subs[s] = true
+
+	go s.forward()
+
+	return s
+}
+
+// cancel stops delivery of events to s
+func (b *bus) cancel(s *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subs, s)
+	close(s.done)
+}
+
+// publish sends e to all subscribers. It doesn't wait for them to receive it, because the publishing window may
+// be a subscriber itself.
+func (b *bus) publish(e interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for s := range b.subs {
+		// The forwarding goroutine is always ready to take events from the queue
+		s.queue <- e
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBusOrder(t *testing.T) {
+	b := &bus{}
+
+	sub := b.subscribe()
+	defer b.cancel(sub)
+
+	// More events than fit in the queue, published before the subscriber receives any of them
+	for i := 0; i < 3*_subscriptionQueue; i++ {
+		b.publish(i)
+	}
+
+	for i := 0; i < 3*_subscriptionQueue; i++ {
+		assert.Equal(t, i, <-sub.C)
+	}
+}
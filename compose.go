@@ -2,12 +2,17 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
+	"net/mail"
 	"os/exec"
+	"strings"
 	"sync"
 
 	"9fans.net/go/acme"
+
+	"github.com/farhaven/acme-notmuch/notmuch"
 )
 
 /* TODO:
@@ -15,56 +20,136 @@ import (
 	- Take a page from Mail's book: references to files end up as included, e.g. !attach /path/to/file at the beginning of a line?
 	- Make "Attachments" a separate window?
 	- Just a list of files to attach?
-- Read ~/.signature
-- Allow specifying the mail template somehow
 - Sanity check mail:
 	- check for attachments on things like "i have attached..."
 */
 
-const newMailTemplate = `From:
-To:
-Subject:
-
-`
-
-func sendMessage(win *acme.Win) error {
+// sendMessage sends the message in win with the sendmail command of the identity matching its From header. If the
+// identity has a folder for sent mail, the message is stored there.
+func sendMessage(nm notmuch.Backend, win *acme.Win) error {
 	body, err := win.ReadAll("body")
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.Command("msmtp", "--read-recipients", "--read-envelope-from")
+	var (
+		ident    identity
+		hasIdent bool
+	)
+
+	from, err := mail.ParseAddress(headerValue(string(body), "From"))
+	if err == nil {
+		ident, hasIdent = identityForAddress(from.Address)
+	}
+
+	sendmail := _config.Compose.Sendmail
+	if hasIdent {
+		sendmail = ident.sendmail()
+	}
+
+	cmd := exec.Command(sendmail[0], sendmail[1:]...)
 	cmd.Stdin = bytes.NewBuffer(body)
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("can't run msmtp: %q: %w", output, err)
+		return fmt.Errorf("can't run %s: %q: %w", sendmail[0], output, err)
 	}
 
 	if len(output) != 0 {
-		win.Errf("got output from msmtp: %q", output)
+		win.Errf("got output from %s: %q", sendmail[0], output)
+	}
+
+	if hasIdent && ident.SentFolder != "" {
+		err = nm.Insert(ident.SentFolder, ident.SentTags, body)
+		if err != nil {
+			return fmt.Errorf("message sent, but can't store it in %s: %w", ident.SentFolder, err)
+		}
 	}
 
 	return nil
 }
 
-func composeReply(wg *sync.WaitGroup, win *acme.Win, messageID string) error {
-	win.Errf("composing reply for %s", messageID)
+// switchIdentity sets the From header and signature of the message in win to the ones of the identity with the
+// given ID. Without an ID, the available identities are listed.
+func switchIdentity(win *acme.Win, id string) error {
+	if id == "" {
+		if len(_config.Identities) == 0 {
+			return errors.New("no identities configured")
+		}
 
-	cmd := exec.Command("notmuch", "reply", "id:"+messageID)
+		var ids []string
+		for _, i := range _config.Identities {
+			ids = append(ids, i.ID+" ("+i.from()+")")
+		}
 
-	output, err := cmd.CombinedOutput()
+		win.Errf("identities: %s", strings.Join(ids, ", "))
+
+		return nil
+	}
+
+	ident, ok := findIdentity(id)
+	if !ok {
+		return fmt.Errorf("no identity %q", id)
+	}
+
+	body, err := win.ReadAll("body")
+	if err != nil {
+		return err
+	}
+
+	text, err := applyIdentity(string(body), ident)
+	if err != nil {
+		return err
+	}
+
+	err = win.Addr(",")
+	if err != nil {
+		return err
+	}
+
+	_, err = win.Write("data", []byte(text))
+
+	return err
+}
+
+// newMessageText returns the template for new messages, with the From header and signature of the default
+// identity
+func newMessageText() (string, error) {
+	ident, ok := defaultIdentity()
+	if !ok {
+		return _config.Compose.Template, nil
+	}
+
+	return applyIdentity(_config.Compose.Template, ident)
+}
+
+func composeReply(wg *sync.WaitGroup, nm notmuch.Backend, win *acme.Win, messageID string) error {
+	win.Errf("composing reply for %s", messageID)
+
+	output, err := nm.Reply(messageID)
 	if err != nil {
 		return fmt.Errorf("notmuch-reply: %w", err)
 	}
 
+	text := string(output)
+
+	ident, ok, err := identityForReply(nm, messageID)
+	if err != nil {
+		win.Errf("can't pick identity for reply, using the one from notmuch: %s", err)
+	} else if ok {
+		text, err = applyIdentity(text, ident)
+		if err != nil {
+			win.Errf("%s", err)
+		}
+	}
+
 	wg.Add(1)
-	go composeMessage(wg, string(output))
+	go composeMessage(wg, nm, text)
 
 	return nil
 }
 
-func composeMessage(wg *sync.WaitGroup, initialText string) {
+func composeMessage(wg *sync.WaitGroup, nm notmuch.Backend, initialText string) {
 	defer wg.Done()
 
 	win, err := newWin("/Mail/newMessage", "TODO")
@@ -73,7 +158,14 @@ func composeMessage(wg *sync.WaitGroup, initialText string) {
 		return
 	}
 
-	err = win.Fprintf("tag", "Send |fmt ")
+	nm = warnTo(nm, win)
+
+	tag := "Send |fmt "
+	if len(_config.Identities) > 1 {
+		tag += "Identity "
+	}
+
+	err = win.Fprintf("tag", "%s", tag)
 	if err != nil {
 		win.Errf("can't update tag: %s", err)
 		return
@@ -94,14 +186,21 @@ func composeMessage(wg *sync.WaitGroup, initialText string) {
 				return
 			}
 		case 'x', 'X':
-			switch string(evt.Text) {
+			cmd, arg := getCommandArgs(evt)
+
+			switch cmd {
 			case "Send":
-				err := sendMessage(win)
+				err := sendMessage(nm, win)
 				if err != nil {
 					win.Errf("Can't send message: %s", err)
 				} else {
 					win.Err("message sent")
 				}
+			case "Identity":
+				err := switchIdentity(win, arg)
+				if err != nil {
+					win.Errf("can't switch identity: %s", err)
+				}
 			default:
 				err := win.WriteEvent(evt)
 				if err != nil {
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/farhaven/acme-notmuch/notmuch"
+)
+
+/* The configuration file is in an INI-like format, similar to the one used by notmuch and git:
+
+	# Comment
+	[message]
+	remove-unread = false
+
+	[search "inbox"]
+	query = tag:inbox
+
+Values may contain the escape sequences \n, \t and \\. All settings are optional, see defaultConfig for the
+defaults.
+*/
+
+type config struct {
+	Message struct {
+		// RemoveUnread removes the "unread" tag from messages when they are opened
+		RemoveUnread bool
+		// Tag is the tag of message windows
+		Tag string
+		// Headers are the headers shown at the top of message windows, in order. "Tags" is a pseudo-header
+		// listing the message's tags.
+		Headers []string
+	}
+	Query struct {
+		// MaxSubjectLen is the length after which subjects are cut off in query and thread windows
+		MaxSubjectLen int
+		// PageSize is the number of results loaded at once in query windows
+		PageSize int
+	}
+	Thread struct {
+		// Columns are the columns of thread windows, in order: "id", "flags", "date", "subject" (with the reply
+		// tree), "from" and "tags"
+		Columns []string
+	}
+	Compose struct {
+		// Template is the initial text of new messages
+		Template string
+		// Sendmail is the command that messages are piped into to send them
+		Sendmail []string
+	}
+	// Delete and Archive are the tag changes made by the Delete and Archive commands
+	Delete  tagAction
+	Archive tagAction
+
+	Spam struct {
+		// SpamTag and HamTag mark messages that were classified as spam or ham
+		SpamTag string
+		HamTag  string
+		// Spam and Ham are the commands that the raw message is piped into to train the classifier
+		Spam []string
+		Ham  []string
+		// SpamToHam and HamToSpam correct an earlier classification
+		SpamToHam []string
+		HamToSpam []string
+	}
+	Mute struct {
+		// Tag marks muted threads
+		Tag string
+		// Strip are the tag changes for new messages in muted threads
+		Strip []string
+	}
+	Watch struct {
+		// Interval is the time between checks for changes of the database, 0 disables them
+		Interval time.Duration
+	}
+	// Searches are shown in the index window in addition to notmuch's named queries
+	Searches []savedSearch
+	// Identities are the sender identities, the first one is the default
+	Identities []identity
+}
+
+// tagAction is a command that changes tags, like Delete and Archive
+type tagAction struct {
+	// Tags are the tag changes, e.g. +deleted -inbox
+	Tags []string
+	// After is what happens to a message window after the command ran: "stay", "close" or "next" (open the next
+	// unread message in the thread and close the window)
+	After string
+}
+
+func defaultConfig() config {
+	var c config
+
+	c.Message.RemoveUnread = true
+	c.Message.Tag = "Next Prev Reply Thread Conversation Headers Raw Archive Delete Undo [Tag +flagged] [|fmt -w 120]"
+	c.Message.Headers = []string{
+		"date", "from", "to", "cc", "bcc", "reply-to", "list-id", "x-bogosity", "content-type", "subject", "tags",
+	}
+
+	c.Query.MaxSubjectLen = 60
+	c.Query.PageSize = 500
+
+	c.Thread.Columns = []string{"id", "flags", "date", "subject", "from", "tags"}
+
+	c.Compose.Template = "From:\nTo:\nSubject:\n\n"
+	c.Compose.Sendmail = []string{"msmtp", "--read-recipients", "--read-envelope-from"}
+
+	c.Spam.SpamTag = "spam"
+	c.Spam.HamTag = "ham"
+	c.Spam.Spam = []string{"bogofilter", "-s"}
+	c.Spam.Ham = []string{"bogofilter", "-n"}
+	c.Spam.SpamToHam = []string{"bogofilter", "-Sn"}
+	c.Spam.HamToSpam = []string{"bogofilter", "-Ns"}
+
+	c.Mute.Tag = "muted"
+	c.Mute.Strip = []string{"-unread", "-inbox"}
+
+	c.Watch.Interval = 30 * time.Second
+
+	c.Delete = tagAction{Tags: []string{"+deleted", "-inbox", "-unread"}, After: "stay"}
+	c.Archive = tagAction{Tags: []string{"-inbox"}, After: "stay"}
+
+	return c
+}
+
+var _config = defaultConfig()
+
+// defaultConfigPath returns $XDG_CONFIG_HOME/acme-notmuch/config, falling back to ~/.config if XDG_CONFIG_HOME is
+// not set
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "acme-notmuch", "config")
+}
+
+// unescapeConfigValue replaces \n, \t and \\ in val
+func unescapeConfigValue(val string) (string, error) {
+	var (
+		res     strings.Builder
+		escaped bool
+	)
+
+	for _, r := range val {
+		if !escaped {
+			if r == '\\' {
+				escaped = true
+			} else {
+				res.WriteRune(r)
+			}
+
+			continue
+		}
+
+		escaped = false
+
+		switch r {
+		case 'n':
+			res.WriteRune('\n')
+		case 't':
+			res.WriteRune('\t')
+		case '\\':
+			res.WriteRune('\\')
+		default:
+			return "", fmt.Errorf("unknown escape sequence \\%c", r)
+		}
+	}
+
+	if escaped {
+		return "", errors.New("value ends in \\")
+	}
+
+	return res.String(), nil
+}
+
+// parseSectionHeader parses `[section]` or `[section "subsection"]`
+func parseSectionHeader(line string) (string, string, error) {
+	if !strings.HasSuffix(line, "]") {
+		return "", "", errors.New("section header doesn't end in ]")
+	}
+
+	line = strings.TrimSpace(line[1 : len(line)-1])
+
+	parts := strings.SplitN(line, " ", 2)
+	section := parts[0]
+
+	if section == "" {
+		return "", "", errors.New("empty section name")
+	}
+
+	if len(parts) == 1 {
+		return section, "", nil
+	}
+
+	sub := strings.TrimSpace(parts[1])
+	if len(sub) < 2 || sub[0] != '"' || sub[len(sub)-1] != '"' {
+		return "", "", fmt.Errorf("subsection name %s must be in double quotes", sub)
+	}
+
+	return section, sub[1 : len(sub)-1], nil
+}
+
+func parseConfigBool(val string) (bool, error) {
+	switch strings.ToLower(val) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0":
+		return false, nil
+	}
+
+	return false, fmt.Errorf("%q is not a boolean", val)
+}
+
+func parseConfigPositiveInt(val string) (int, error) {
+	n, err := strconv.Atoi(val)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a positive number", val)
+	}
+
+	return n, nil
+}
+
+// _configSubsections are the sections that have named subsections, e.g. [search "inbox"]
+var _configSubsections = map[string]bool{
+	"search":   true,
+	"identity": true,
+}
+
+// identity returns the identity with the given ID, adding it if it doesn't exist yet
+func (c *config) identity(id string) *identity {
+	for idx := range c.Identities {
+		if c.Identities[idx].ID == id {
+			return &c.Identities[idx]
+		}
+	}
+
+	c.Identities = append(c.Identities, identity{
+		ID:       id,
+		SentTags: []string{"+sent", "-unread", "-inbox"},
+	})
+
+	return &c.Identities[len(c.Identities)-1]
+}
+
+// set sets key in the given section and subsection to val
+func (c *config) set(section, sub, key, val string) error {
+	var err error
+
+	switch section + "." + key {
+	case "message.remove-unread":
+		c.Message.RemoveUnread, err = parseConfigBool(val)
+	case "message.tag":
+		c.Message.Tag = val
+	case "message.headers":
+		c.Message.Headers = strings.Fields(strings.ToLower(val))
+	case "query.max-subject-length":
+		c.Query.MaxSubjectLen, err = parseConfigPositiveInt(val)
+	case "query.page-size":
+		c.Query.PageSize, err = parseConfigPositiveInt(val)
+	case "thread.columns":
+		cols := strings.Fields(strings.ToLower(val))
+
+		hasID := false
+		for _, col := range cols {
+			switch col {
+			case "id":
+				hasID = true
+			case "flags", "date", "subject", "from", "tags":
+			default:
+				return fmt.Errorf("unknown column %q", col)
+			}
+		}
+
+		if !hasID {
+			return errors.New(`columns must include "id"`)
+		}
+
+		c.Thread.Columns = cols
+	case "compose.template":
+		c.Compose.Template = val
+	case "compose.sendmail":
+		c.Compose.Sendmail = strings.Fields(val)
+		if len(c.Compose.Sendmail) == 0 {
+			err = errors.New("sendmail command is empty")
+		}
+	case "delete.tags", "archive.tags":
+		action := &c.Delete
+		if section == "archive" {
+			action = &c.Archive
+		}
+
+		action.Tags = strings.Fields(val)
+		if len(action.Tags) == 0 {
+			return errors.New("no tag changes given")
+		}
+
+		err = notmuch.CheckTagOps(action.Tags)
+	case "delete.after", "archive.after":
+		action := &c.Delete
+		if section == "archive" {
+			action = &c.Archive
+		}
+
+		switch val {
+		case "stay", "close", "next":
+			action.After = val
+		default:
+			err = fmt.Errorf("%q is not one of stay, close or next", val)
+		}
+	case "mute.tag":
+		if val == "" || strings.ContainsAny(val, " \t") {
+			return fmt.Errorf("%q is not a tag", val)
+		}
+
+		c.Mute.Tag = val
+	case "mute.strip":
+		c.Mute.Strip = strings.Fields(val)
+		if len(c.Mute.Strip) == 0 {
+			return errors.New("no tag changes given")
+		}
+
+		err = notmuch.CheckTagOps(c.Mute.Strip)
+	case "spam.spam-tag", "spam.ham-tag":
+		if val == "" || strings.ContainsAny(val, " \t") {
+			return fmt.Errorf("%q is not a tag", val)
+		}
+
+		if key == "spam-tag" {
+			c.Spam.SpamTag = val
+		} else {
+			c.Spam.HamTag = val
+		}
+	case "spam.spam", "spam.ham", "spam.spam-to-ham", "spam.ham-to-spam":
+		cmd := strings.Fields(val)
+		if len(cmd) == 0 {
+			return errors.New("classifier command is empty")
+		}
+
+		switch key {
+		case "spam":
+			c.Spam.Spam = cmd
+		case "ham":
+			c.Spam.Ham = cmd
+		case "spam-to-ham":
+			c.Spam.SpamToHam = cmd
+		case "ham-to-spam":
+			c.Spam.HamToSpam = cmd
+		}
+	case "watch.interval":
+		c.Watch.Interval, err = time.ParseDuration(val)
+		if err == nil && c.Watch.Interval < 0 {
+			err = fmt.Errorf("%q is negative", val)
+		}
+	case "search.query":
+		if sub == "" {
+			return errors.New(`saved searches need a name, e.g. [search "inbox"]`)
+		}
+
+		if val == "" {
+			return fmt.Errorf("empty query for saved search %q", sub)
+		}
+
+		for idx, s := range c.Searches {
+			if s.Name == sub {
+				c.Searches[idx].Query = val
+				return nil
+			}
+		}
+
+		c.Searches = append(c.Searches, savedSearch{Name: sub, Query: val})
+	case "identity.name", "identity.address", "identity.signature", "identity.sendmail", "identity.sent-folder",
+		"identity.sent-tags":
+		if sub == "" {
+			return errors.New(`identities need a name, e.g. [identity "work"]`)
+		}
+
+		ident := c.identity(sub)
+
+		switch key {
+		case "name":
+			ident.Name = val
+		case "address":
+			addr, err := mail.ParseAddress(val)
+			if err != nil {
+				return fmt.Errorf("invalid address %q: %w", val, err)
+			}
+
+			ident.Address = addr.Address
+		case "signature":
+			ident.Signature = val
+		case "sendmail":
+			ident.Sendmail = strings.Fields(val)
+			if len(ident.Sendmail) == 0 {
+				err = errors.New("sendmail command is empty")
+			}
+		case "sent-folder":
+			ident.SentFolder = val
+		case "sent-tags":
+			ident.SentTags = strings.Fields(val)
+			err = notmuch.CheckTagOps(ident.SentTags)
+		}
+	default:
+		return fmt.Errorf("unknown setting %q in section %q", key, section)
+	}
+
+	return err
+}
+
+// parseConfig reads configuration from r on top of the defaults. All problems are reported at once, each prefixed
+// with name and the line number.
+func parseConfig(name string, r io.Reader) (config, error) {
+	c := defaultConfig()
+
+	var (
+		errs         []string
+		section, sub string
+		lineNo       int
+		haveSection  bool
+	)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		fail := func(err error) {
+			errs = append(errs, fmt.Sprintf("%s:%d: %s", name, lineNo, err))
+		}
+
+		if strings.HasPrefix(line, "[") {
+			var err error
+
+			section, sub, err = parseSectionHeader(line)
+			if err == nil && sub != "" && !_configSubsections[section] {
+				err = fmt.Errorf("section %q has no subsections", section)
+			}
+
+			if err != nil {
+				fail(err)
+			}
+
+			haveSection = err == nil
+
+			continue
+		}
+
+		if !haveSection {
+			fail(errors.New("setting outside of a section"))
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			fail(errors.New("expected key = value"))
+			continue
+		}
+
+		key := strings.TrimSpace(parts[0])
+
+		val, err := unescapeConfigValue(strings.TrimSpace(parts[1]))
+		if err != nil {
+			fail(err)
+			continue
+		}
+
+		err = c.set(section, sub, key, val)
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+	}
+
+	for _, ident := range c.Identities {
+		if ident.Address == "" {
+			errs = append(errs, fmt.Sprintf("%s: identity %q has no address", name, ident.ID))
+		}
+	}
+
+	if len(errs) != 0 {
+		return c, errors.New(strings.Join(errs, "\n"))
+	}
+
+	return c, nil
+}
+
+// loadConfig loads the configuration file at path. A missing file is not an error, the defaults are returned
+// instead.
+func loadConfig(path string) (config, error) {
+	if path == "" {
+		return defaultConfig(), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return defaultConfig(), nil
+		}
+
+		return config{}, err
+	}
+	defer f.Close()
+
+	return parseConfig(path, f)
+}
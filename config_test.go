@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	input := `# Settings for message windows
+[message]
+remove-unread = no
+headers = From Subject
+
+[compose]
+template = From: me@example.com\nTo:\nSubject:\n\n
+sendmail = /usr/sbin/sendmail -t
+
+[search "inbox"]
+query = tag:inbox
+
+[search "todo"]
+; comments with semicolons work as well
+query = tag:todo and not tag:done
+`
+
+	c, err := parseConfig("config", strings.NewReader(input))
+	require.NoError(t, err)
+
+	assert.False(t, c.Message.RemoveUnread)
+	assert.Equal(t, []string{"from", "subject"}, c.Message.Headers)
+	assert.Equal(t, "Next Prev Reply Thread Conversation Headers Raw Archive Delete Undo [Tag +flagged] [|fmt -w 120]", c.Message.Tag)
+	assert.Equal(t, 60, c.Query.MaxSubjectLen)
+	assert.Equal(t, "From: me@example.com\nTo:\nSubject:\n\n", c.Compose.Template)
+	assert.Equal(t, []string{"/usr/sbin/sendmail", "-t"}, c.Compose.Sendmail)
+	assert.Equal(t, []savedSearch{
+		{Name: "inbox", Query: "tag:inbox"},
+		{Name: "todo", Query: "tag:todo and not tag:done"},
+	}, c.Searches)
+}
+
+func TestParseConfig_Errors(t *testing.T) {
+	input := `remove-unread = false
+[message]
+remove-unread = maybe
+colour = blue
+[query]
+page-size = -1
+[query "foo"]
+[compose]
+sendmail =
+template = \x
+[search]
+query = tag:inbox
+`
+
+	_, err := parseConfig("config", strings.NewReader(input))
+	require.Error(t, err)
+
+	assert.Equal(t, []string{
+		"config:1: setting outside of a section",
+		`config:3: "maybe" is not a boolean`,
+		`config:4: unknown setting "colour" in section "message"`,
+		`config:6: "-1" is not a positive number`,
+		`config:7: section "query" has no subsections`,
+		"config:9: sendmail command is empty",
+		`config:10: unknown escape sequence \x`,
+		`config:12: saved searches need a name, e.g. [search "inbox"]`,
+	}, strings.Split(err.Error(), "\n"))
+}
+
+func TestParseConfig_Actions(t *testing.T) {
+	input := `[delete]
+tags = +trash -inbox
+after = next
+[archive]
+after = later
+tags = inbox
+`
+
+	c, err := parseConfig("config", strings.NewReader(input))
+	require.Error(t, err)
+
+	assert.Equal(t, []string{
+		`config:5: "later" is not one of stay, close or next`,
+		`config:6: "inbox" is not a tag change, expected +tag or -tag`,
+	}, strings.Split(err.Error(), "\n"))
+
+	assert.Equal(t, tagAction{Tags: []string{"+trash", "-inbox"}, After: "next"}, c.Delete)
+	assert.Equal(t, "stay", c.Archive.After)
+}
+
+func TestParseConfig_ThreadColumns(t *testing.T) {
+	c, err := parseConfig("config", strings.NewReader("[thread]\ncolumns = ID Subject Date\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"id", "subject", "date"}, c.Thread.Columns)
+
+	_, err = parseConfig("config", strings.NewReader("[thread]\ncolumns = subject size\n"))
+	assert.EqualError(t, err, `config:2: unknown column "size"`)
+
+	_, err = parseConfig("config", strings.NewReader("[thread]\ncolumns = subject\n"))
+	assert.EqualError(t, err, `config:2: columns must include "id"`)
+}
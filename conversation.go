@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"9fans.net/go/acme"
+
+	"github.com/farhaven/acme-notmuch/message"
+	"github.com/farhaven/acme-notmuch/notmuch"
+)
+
+// _conversationHeaders are the headers shown above each expanded message of conversation windows
+var _conversationHeaders = []string{"from", "date", "to", "cc"}
+
+// conversationEntry is a message of a conversation window. Collapsed messages only have their summary line.
+type conversationEntry struct {
+	Line    string
+	Message *message.Root
+}
+
+// conversationEntries returns the messages of the thread with the given ID, in the order they are shown in the
+// conversation window. Messages that expanded maps to false are collapsed to a single line. Messages that aren't in
+// expanded yet are added to it, and expanded if they are unread. The thread is loaded with a single call to notmuch.
+func conversationEntries(nm notmuch.Backend, threadID string, expanded map[string]bool) ([]conversationEntry, error) {
+	output, err := nm.Show("thread:"+threadID, notmuch.ShowOptions{
+		EntireThread: true,
+		Body:         true,
+		IncludeHTML:  true,
+		Decrypt:      true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting output from notmuch: %w", err)
+	}
+
+	threads, err := parseThreads(output)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshaling thread %s: %w", threadID, err)
+	}
+
+	if len(threads) != 1 {
+		return nil, fmt.Errorf("expected one thread %s, got %d", threadID, len(threads))
+	}
+
+	var entries []conversationEntry
+
+	for _, n := range threads[0].PreOrder() {
+		if n.Message == nil {
+			continue
+		}
+
+		id := n.Message.ID
+
+		if _, ok := expanded[id]; !ok {
+			expanded[id] = n.Message.TagSet().Tags["unread"]
+		}
+
+		line, err := n.Message.Line("", _messageIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := conversationEntry{Line: line}
+
+		if expanded[id] {
+			var msg message.Root
+
+			err = json.Unmarshal(n.raw, &msg)
+			if err != nil {
+				return nil, fmt.Errorf("decoding message %s: %w", id, err)
+			}
+
+			entry.Message = &msg
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// conversationHeaders returns the header block shown above an expanded message in conversation windows
+func conversationHeaders(msg message.Root) string {
+	var headers []string
+
+	for _, hdr := range _conversationHeaders {
+		val := msg.Headers[strings.Title(hdr)]
+		if val == "" {
+			continue
+		}
+
+		if hdr == "date" {
+			date, err := mail.ParseDate(val)
+			if err == nil {
+				val = date.Format(time.RFC3339)
+			}
+		}
+
+		headers = append(headers, strings.Title(hdr)+":\t"+val)
+	}
+
+	crypto := msg.Crypto.Render("\t")
+	if crypto != "" {
+		headers = append(headers, "Crypto:"+crypto)
+	}
+
+	return strings.Join(headers, "\n")
+}
+
+// renderConversation returns the text of the conversation window showing entries
+func renderConversation(win *acme.Win, entries []conversationEntry) string {
+	var (
+		text      strings.Builder
+		collapsed []string
+	)
+
+	// Consecutive collapsed messages are aligned together, like the lines of thread windows
+	flush := func() {
+		if len(collapsed) != 0 {
+			text.WriteString(formatTabbed(win, strings.Join(collapsed, "\n")))
+			collapsed = nil
+		}
+	}
+
+	for _, e := range entries {
+		if e.Message == nil {
+			collapsed = append(collapsed, e.Line)
+			continue
+		}
+
+		flush()
+
+		headers := formatTabbed(win, conversationHeaders(*e.Message))
+		body := strings.TrimRight(e.Message.Render(), "\n")
+
+		text.WriteString("\n" + formatTabbed(win, e.Line) + headers + "\n" + body + "\n\n")
+	}
+
+	flush()
+
+	return text.String()
+}
+
+// updateConversation updates the conversation window without clearing it, so that dot and the scroll position are
+// kept. It returns the entries that are shown now. If the window was edited, it is left alone and nil is returned.
+func updateConversation(win *acme.Win, nm notmuch.Backend, threadID string, expanded map[string]bool) (
+	[]conversationEntry, error) {
+	dirty, err := isDirty(win)
+	if err != nil || dirty {
+		return nil, err
+	}
+
+	entries, err := conversationEntries(nm, threadID, expanded)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, replaceBody(win, renderConversation(win, entries))
+}
+
+// markExpandedRead removes the "unread" tag from the expanded messages in entries, like opening them in message
+// windows does. It returns the IDs of the messages that were unread.
+func markExpandedRead(nm notmuch.Backend, entries []conversationEntry) ([]string, error) {
+	if !_config.Message.RemoveUnread {
+		return nil, nil
+	}
+
+	var ids, queries []string
+	for _, e := range entries {
+		if e.Message != nil && (ThreadMessage{Tags: e.Message.Tags}).TagSet().Tags["unread"] {
+			ids = append(ids, e.Message.ID)
+			queries = append(queries, "id:"+e.Message.ID)
+		}
+	}
+
+	if len(queries) == 0 {
+		return nil, nil
+	}
+
+	return ids, tagEach(nm, []string{"-unread"}, queries)
+}
+
+// ownChanges are the IDs of messages whose tags a conversation window changed itself. The window is already up to
+// date, so it doesn't have to render itself again when it is told about the change.
+type ownChanges map[string]bool
+
+// add remembers that the tags of the messages with the given IDs were changed
+func (c ownChanges) add(ids []string) {
+	for _, id := range ids {
+		c[id] = true
+	}
+}
+
+// skip returns whether e only reports changes made by the window itself, and forgets about them
+func (c ownChanges) skip(e tagEvent) bool {
+	for _, id := range e.MessageIDs {
+		if !c[id] {
+			return false
+		}
+	}
+
+	for _, id := range e.MessageIDs {
+		delete(c, id)
+	}
+
+	return len(e.MessageIDs) != 0
+}
+
+// displayConversation shows all messages of the thread with the given ID in one window. Unread messages are shown in
+// full, read ones are collapsed to one line.
+func displayConversation(wg *sync.WaitGroup, nm notmuch.Backend, threadID string) {
+	defer wg.Done()
+
+	reg := _windows.open("conversation", threadID)
+	if reg == nil {
+		// Already open
+		return
+	}
+	defer _windows.close(reg)
+
+	win, err := newWin("/Mail/conversation/"+threadID, "Get Expand Collapse")
+	if err != nil {
+		log.Printf("can't open conversation window for %s: %s", threadID, err)
+		return
+	}
+
+	nm = warnTo(nm, win)
+
+	err = win.Fprintf("data", "Looking for thread %s", threadID)
+	if err != nil {
+		win.Errf("can't write to body: %s", err)
+		return
+	}
+
+	expanded := make(map[string]bool)
+
+	entries, err := conversationEntries(nm, threadID, expanded)
+	if err != nil {
+		win.Fprintf("data", "\n%s\n", describeError(err))
+		winClean(win)
+		win.Errf("can't show conversation %s: %s", threadID, err)
+
+		return
+	}
+
+	win.Clear()
+	win.Fprintf("body", "%s", renderConversation(win, entries))
+	winClean(win)
+
+	_, err = markExpandedRead(nm, entries)
+	if err != nil {
+		win.Errf("can't remove 'unread' tag from messages: %s", err)
+	}
+
+	sub := _bus.subscribe()
+	defer _bus.cancel(sub)
+
+	own := make(ownChanges)
+
+	events := win.EventChan()
+
+	for {
+		var evt *acme.Event
+
+		select {
+		case e := <-sub.C:
+			switch e := e.(type) {
+			case tagEvent:
+				if !e.hasThread(threadID) || own.skip(e) {
+					continue
+				}
+			case dbChanged:
+			default:
+				continue
+			}
+
+			_, err = updateConversation(win, nm, threadID, expanded)
+			if err != nil {
+				win.Errf("can't update conversation %s: %s", threadID, err)
+			}
+
+			continue
+		case <-reg.Raise:
+			err = win.Ctl("show")
+			if err == nil {
+				_, err = updateConversation(win, nm, threadID, expanded)
+			}
+
+			if err != nil {
+				win.Errf("can't update conversation %s: %s", threadID, err)
+			}
+
+			continue
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+
+			evt = ev
+		}
+
+		switch evt.C2 {
+		case 'x', 'X':
+			switch string(evt.Text) {
+			case "Get":
+				// Start over with only the unread messages expanded
+				expanded = make(map[string]bool)
+
+				entries, err = conversationEntries(nm, threadID, expanded)
+				if err != nil {
+					win.Errf("can't show conversation %s: %s", threadID, err)
+					continue
+				}
+
+				win.Clear()
+				win.Fprintf("body", "%s", renderConversation(win, entries))
+				winClean(win)
+
+				read, err := markExpandedRead(nm, entries)
+				own.add(read)
+
+				if err != nil {
+					win.Errf("can't remove 'unread' tag from messages: %s", err)
+				}
+
+				continue
+			case "Expand", "Collapse":
+				ids, err := selectedMessages(win)
+
+				changed := make(map[string]bool)
+				if err == nil {
+					for _, id := range ids {
+						expanded[id] = string(evt.Text) == "Expand"
+						changed[id] = true
+					}
+
+					entries, err = updateConversation(win, nm, threadID, expanded)
+				}
+
+				if err != nil {
+					win.Errf("can't %s messages: %s", strings.ToLower(string(evt.Text)), err)
+					continue
+				}
+
+				// Expanding a message reads it, like the initial rendering does for unread ones
+				var newlyExpanded []conversationEntry
+				for _, e := range entries {
+					if e.Message != nil && changed[e.Message.ID] {
+						newlyExpanded = append(newlyExpanded, e)
+					}
+				}
+
+				read, err := markExpandedRead(nm, newlyExpanded)
+				own.add(read)
+
+				if err != nil {
+					win.Errf("can't remove 'unread' tag from messages: %s", err)
+				}
+
+				continue
+			}
+
+			err := handleCommand(wg, nm, win, evt)
+			switch err {
+			case nil:
+				// Nothing to do, event already handled
+			case errNotACommand:
+				// Let ACME handle the event
+				err := win.WriteEvent(evt)
+				if err != nil {
+					return
+				}
+			default:
+				win.Errf("can't handle event: %s", err)
+			}
+		case 'l', 'L':
+			err := look(wg, nm, string(evt.Text), "")
+			switch err {
+			case nil:
+			case errNoMessage:
+				// Doesn't look like a message ID, send it back to ACME
+				err := win.WriteEvent(evt)
+				if err != nil {
+					win.Errf("can't write event: %s", err)
+				}
+			default:
+				win.Errf("lookup failed: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/farhaven/acme-notmuch/notmuch"
+)
+
+// showCounter counts the calls to Show and ShowRaw
+type showCounter struct {
+	notmuch.Backend
+	calls int
+}
+
+func (c *showCounter) Show(query string, opts notmuch.ShowOptions) ([]byte, error) {
+	c.calls++
+	return c.Backend.Show(query, opts)
+}
+
+func (c *showCounter) ShowRaw(messageID string) ([]byte, error) {
+	c.calls++
+	return c.Backend.ShowRaw(messageID)
+}
+
+func TestConversationEntries(t *testing.T) {
+	fake, restore := setupTagTest(t)
+	defer restore()
+
+	expanded := make(map[string]bool)
+
+	nm := &showCounter{Backend: fake}
+
+	entries, err := conversationEntries(nm, "0000000000000001", expanded)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+
+	// The whole thread is loaded at once
+	assert.Equal(t, 1, nm.calls)
+	assert.Equal(t, "From:\tBob <bob@example.com>\nDate:\t2020-07-20T13:16:40Z\n"+
+		"To:\tAlice <alice@example.com>\nCc:\toffice@example.com", conversationHeaders(*entries[1].Message))
+
+	// Only the unread messages are expanded at first, in the order of the reply tree
+	var ids []string
+	for _, e := range entries {
+		if e.Message != nil {
+			ids = append(ids, e.Message.ID)
+		}
+	}
+
+	assert.Equal(t, []string{"reply1@example.com", "reply2@example.com", "reply3@example.com"}, ids)
+	assert.Equal(t, map[string]bool{
+		"root@example.com":   false,
+		"reply1@example.com": true,
+		"reply2@example.com": true,
+		"reply3@example.com": true,
+	}, expanded)
+
+	// Collapsing and expanding is kept across renderings
+	expanded["root@example.com"] = true
+	expanded["reply2@example.com"] = false
+
+	entries, err = conversationEntries(fake, "0000000000000001", expanded)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	assert.NotNil(t, entries[0].Message)
+	assert.Nil(t, entries[2].Message)
+	assert.NotEmpty(t, entries[2].Line)
+
+	// Only the expanded messages that are unread are marked as read
+	read, err := markExpandedRead(fake, entries[:2])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"reply1@example.com"}, read)
+	assert.Equal(t, 2, countMessages(t, fake, "thread:0000000000000001 and tag:unread"))
+}
+
+func TestOwnChanges(t *testing.T) {
+	own := make(ownChanges)
+	own.add([]string{"a@example.com", "b@example.com"})
+
+	assert.False(t, own.skip(tagEvent{MessageIDs: []string{"a@example.com", "c@example.com"}}))
+	assert.True(t, own.skip(tagEvent{MessageIDs: []string{"a@example.com", "b@example.com"}}))
+
+	// Each change is only skipped once
+	assert.False(t, own.skip(tagEvent{MessageIDs: []string{"a@example.com"}}))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/farhaven/acme-notmuch/notmuch"
+)
+
+// loadTestFake returns a Fake backend with the threads from the notmuch package's test data
+func loadTestFake(t *testing.T) *notmuch.Fake {
+	f, err := os.Open("notmuch/test-data/threads.json")
+	require.NoError(t, err)
+	defer f.Close()
+
+	fake, err := notmuch.LoadFake(f)
+	require.NoError(t, err)
+
+	return fake
+}
+
+// setupTagTest returns a Fake backend like loadTestFake and replaces the journal with an empty one, for tests that
+// change tags. The returned function restores the journal.
+func setupTagTest(t *testing.T) (*notmuch.Fake, func()) {
+	j, err := openJournal("")
+	require.NoError(t, err)
+
+	old := _journal
+	_journal = j
+
+	return loadTestFake(t), func() { _journal = old }
+}
+
+// countMessages returns the number of messages matching query, without excluding any
+func countMessages(t *testing.T, nm notmuch.Backend, query string) int {
+	n, err := nm.Count(query, notmuch.CountOptions{IncludeExcluded: true})
+	require.NoError(t, err)
+
+	return n
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"9fans.net/go/acme"
+
+	"github.com/farhaven/acme-notmuch/notmuch"
+)
+
+// _historyLen is the number of groups of changes shown in the history window
+const _historyLen = 100
+
+// _groupIDRegex matches references to groups of changes in the history window, e.g. #17
+var _groupIDRegex = regexp.MustCompile(`^#([0-9]+)$`)
+
+// historyLines returns the lines listing the recent changes from the journal
+func historyLines() []string {
+	var lines []string
+	for _, g := range _journal.recent(_historyLen) {
+		lines = append(lines, g.String())
+	}
+
+	if len(lines) == 0 {
+		lines = append(lines, "No changes recorded")
+	}
+
+	return lines
+}
+
+// refreshHistory lists the recent changes from the journal in win
+func refreshHistory(win *acme.Win) error {
+	win.Clear()
+	win.PrintTabbed(strings.Join(historyLines(), "\n"))
+
+	return winClean(win)
+}
+
+// displayHistory opens the history window, which lists recent tag changes. Looking at the ID of a group of changes
+// (#17) reverts it.
+func displayHistory(wg *sync.WaitGroup, nm notmuch.Backend) error {
+	defer wg.Done()
+
+	reg := _windows.open("history", "")
+	if reg == nil {
+		// Already open
+		return nil
+	}
+	defer _windows.close(reg)
+
+	win, err := newWin("/Mail/history", "Get Undo")
+	if err != nil {
+		return err
+	}
+
+	nm = warnTo(nm, win)
+
+	err = refreshHistory(win)
+	if err != nil {
+		win.Errf("can't list changes: %s", err)
+	}
+
+	sub := _bus.subscribe()
+	defer _bus.cancel(sub)
+
+	events := win.EventChan()
+
+	for {
+		var evt *acme.Event
+
+		select {
+		case e := <-sub.C:
+			if _, ok := e.(tagEvent); !ok {
+				continue
+			}
+
+			// New changes were recorded
+			err = replaceBody(win, formatTabbed(win, strings.Join(historyLines(), "\n")))
+			if err != nil {
+				win.Errf("can't list changes: %s", err)
+			}
+
+			continue
+		case <-reg.Raise:
+			err = win.Ctl("show")
+			if err == nil {
+				err = refreshHistory(win)
+			}
+
+			if err != nil {
+				win.Errf("can't list changes: %s", err)
+			}
+
+			continue
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+
+			evt = ev
+		}
+
+		switch evt.C2 {
+		case 'l', 'L':
+		case 'x', 'X':
+			cmd, _ := getCommandArgs(evt)
+			if cmd == "Get" {
+				err = refreshHistory(win)
+				if err != nil {
+					win.Errf("can't list changes: %s", err)
+				}
+
+				continue
+			}
+
+			err := handleCommand(wg, nm, win, evt)
+			switch err {
+			case nil:
+				if cmd == "Undo" {
+					err = refreshHistory(win)
+					if err != nil {
+						win.Errf("can't list changes: %s", err)
+					}
+				}
+			case errNotACommand:
+				// Let ACME handle the event
+				err := win.WriteEvent(evt)
+				if err != nil {
+					return err
+				}
+			}
+
+			continue
+		default:
+			continue
+		}
+
+		// Short message IDs from other windows
+		if look(wg, nm, string(evt.Text), "") == nil {
+			continue
+		}
+
+		m := _groupIDRegex.FindStringSubmatch(strings.TrimSpace(string(evt.Text)))
+		if m == nil {
+			// Not a group ID, send it back to ACME
+			err := win.WriteEvent(evt)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		group, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			win.Errf("invalid change %s: %s", m[0], err)
+			continue
+		}
+
+		err = undoGroup(nm, group)
+		if err != nil {
+			win.Errf("can't revert %s: %s", m[0], describeError(err))
+		}
+
+		err = refreshHistory(win)
+		if err != nil {
+			win.Errf("can't list changes: %s", err)
+		}
+	}
+}
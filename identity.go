@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/farhaven/acme-notmuch/notmuch"
+)
+
+// identity is a configured sender identity, e.g. [identity "work"]
+type identity struct {
+	ID         string   // Name of the config subsection
+	Name       string   // Real name for the From header
+	Address    string   // Mail address for the From header
+	Signature  string   // Path to the signature file, may be empty
+	Sendmail   []string // Command to send mail with, defaults to the sendmail command from [compose]
+	SentFolder string   // Maildir folder that sent messages are stored in, may be empty
+	SentTags   []string // Tag changes for stored sent messages
+}
+
+// from returns the value of the From header for i
+func (i identity) from() string {
+	addr := mail.Address{Name: i.Name, Address: i.Address}
+	return addr.String()
+}
+
+func (i identity) sendmail() []string {
+	if len(i.Sendmail) == 0 {
+		return _config.Compose.Sendmail
+	}
+
+	return i.Sendmail
+}
+
+// signature returns the content of i's signature file, or an empty string if there is none
+func (i identity) signature() (string, error) {
+	if i.Signature == "" {
+		return "", nil
+	}
+
+	path := i.Signature
+	if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+
+		path = filepath.Join(home, path[2:])
+	}
+
+	sig, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(sig), "\n"), nil
+}
+
+// findIdentity returns the identity with the given ID
+func findIdentity(id string) (identity, bool) {
+	for _, i := range _config.Identities {
+		if i.ID == id {
+			return i, true
+		}
+	}
+
+	return identity{}, false
+}
+
+// identityForAddress returns the identity that uses addr
+func identityForAddress(addr string) (identity, bool) {
+	for _, i := range _config.Identities {
+		if strings.EqualFold(i.Address, addr) {
+			return i, true
+		}
+	}
+
+	return identity{}, false
+}
+
+// defaultIdentity returns the first configured identity
+func defaultIdentity() (identity, bool) {
+	if len(_config.Identities) == 0 {
+		return identity{}, false
+	}
+
+	return _config.Identities[0], true
+}
+
+// _recipientHeaders are the headers that are checked to find out which identity a message was sent to
+var _recipientHeaders = []string{"Delivered-To", "X-Original-To", "Envelope-To", "To", "Cc"}
+
+// identityForReply picks the identity that a reply to the message with the given ID should be sent from, based on
+// the addresses the message was sent to. If none matches, the default identity is used.
+func identityForReply(nm notmuch.Backend, messageID string) (identity, bool, error) {
+	raw, err := nm.ShowRaw(messageID)
+	if err != nil {
+		return identity{}, false, err
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return identity{}, false, fmt.Errorf("parsing message: %w", err)
+	}
+
+	for _, hdr := range _recipientHeaders {
+		addrs, err := msg.Header.AddressList(hdr)
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if ident, ok := identityForAddress(addr.Address); ok {
+				return ident, true, nil
+			}
+		}
+	}
+
+	ident, ok := defaultIdentity()
+
+	return ident, ok, nil
+}
+
+// splitMessage splits text at the blank line after the header block
+func splitMessage(text string) (string, string) {
+	if strings.HasPrefix(text, "\n") {
+		return "", text[1:]
+	}
+
+	idx := strings.Index(text, "\n\n")
+	if idx == -1 {
+		return text, ""
+	}
+
+	return text[:idx+1], text[idx+2:]
+}
+
+// setHeader replaces the value of hdr in the header block of text, or adds hdr at the top if it isn't present
+func setHeader(text, hdr, value string) string {
+	headers, body := splitMessage(text)
+
+	var (
+		res      []string
+		replaced bool
+		skipping bool
+	)
+
+	prefix := strings.ToLower(hdr) + ":"
+
+	for _, line := range strings.SplitAfter(headers, "\n") {
+		if line == "" {
+			continue
+		}
+
+		if skipping && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			// Continuation line of the replaced header
+			continue
+		}
+
+		skipping = false
+
+		if !replaced && strings.HasPrefix(strings.ToLower(line), prefix) {
+			res = append(res, hdr+": "+value+"\n")
+			replaced = true
+			skipping = true
+
+			continue
+		}
+
+		res = append(res, line)
+	}
+
+	if !replaced {
+		res = append([]string{hdr + ": " + value + "\n"}, res...)
+	}
+
+	return strings.Join(res, "") + "\n" + body
+}
+
+// headerValue returns the value of hdr from the header block of text
+func headerValue(text, hdr string) string {
+	headers, _ := splitMessage(text)
+
+	msg, err := mail.ReadMessage(strings.NewReader(headers + "\n"))
+	if err != nil {
+		return ""
+	}
+
+	return msg.Header.Get(hdr)
+}
+
+// _signatureSeparator separates the signature from the rest of a message
+const _signatureSeparator = "\n-- \n"
+
+// setSignature replaces the signature at the end of text with sig. If sig is empty, the signature is removed.
+func setSignature(text, sig string) string {
+	idx := strings.LastIndex(text, _signatureSeparator)
+	if idx != -1 {
+		text = text[:idx+1]
+	}
+
+	if sig == "" {
+		return text
+	}
+
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+
+	return text + _signatureSeparator[1:] + sig + "\n"
+}
+
+// applyIdentity sets the From header and signature of the message in text to the ones of ident
+func applyIdentity(text string, ident identity) (string, error) {
+	sig, err := ident.signature()
+	if err != nil {
+		return text, fmt.Errorf("reading signature of identity %q: %w", ident.ID, err)
+	}
+
+	text = setHeader(text, "From", ident.from())
+
+	return setSignature(text, sig), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetHeader(t *testing.T) {
+	text := "Subject: Re: Stapler\nFrom: Someone\n <someone@example.com>\nTo: bob@example.com\n\nFrom: this is the body\n"
+
+	assert.Equal(t,
+		"Subject: Re: Stapler\nFrom: Alice <alice@example.com>\nTo: bob@example.com\n\nFrom: this is the body\n",
+		setHeader(text, "From", "Alice <alice@example.com>"))
+
+	assert.Equal(t,
+		"From: alice@example.com\nTo:\n\nbody\n",
+		setHeader("To:\n\nbody\n", "From", "alice@example.com"))
+
+	assert.Equal(t, "bob@example.com", headerValue(text, "To"))
+}
+
+func TestSetSignature(t *testing.T) {
+	assert.Equal(t, "Hi\n-- \nAlice\n", setSignature("Hi\n", "Alice"))
+	assert.Equal(t, "Hi\n-- \nAlice at work\n", setSignature("Hi\n-- \nAlice\n", "Alice at work"))
+	assert.Equal(t, "Hi\n", setSignature("Hi\n-- \nAlice\n", ""))
+}
+
+func TestParseConfig_Identities(t *testing.T) {
+	input := `[identity "personal"]
+name = Alice
+address = alice@example.com
+
+[identity "work"]
+name = Alice Smith
+address = Alice Smith <alice.smith@example.org>
+sendmail = msmtp -a work --read-recipients
+sent-folder = work/Sent
+`
+
+	c, err := parseConfig("config", strings.NewReader(input))
+	require.NoError(t, err)
+	require.Len(t, c.Identities, 2)
+
+	assert.Equal(t, "personal", c.Identities[0].ID)
+	assert.Equal(t, `"Alice Smith" <alice.smith@example.org>`, c.Identities[1].from())
+	assert.Equal(t, []string{"msmtp", "-a", "work", "--read-recipients"}, c.Identities[1].Sendmail)
+	assert.Equal(t, []string{"+sent", "-unread", "-inbox"}, c.Identities[1].SentTags)
+
+	_, err = parseConfig("config", strings.NewReader("[identity \"x\"]\nname = X\nsent-tags = sent\n"))
+	assert.EqualError(t, err, "config:3: \"sent\" is not a tag change, expected +tag or -tag\nconfig: identity \"x\" has no address")
+}
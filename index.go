@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"9fans.net/go/acme"
+
+	"github.com/farhaven/acme-notmuch/notmuch"
+)
+
+// savedSearch is a named query shown in the index window
+type savedSearch struct {
+	Name  string
+	Query string
+}
+
+// savedSearches returns the searches from the configuration file, followed by the named queries from notmuch's
+// configuration ("query.<name>" keys) sorted by name. If there are none, the initial query from the command line
+// is returned as the only saved search.
+func savedSearches(nm notmuch.Backend) ([]savedSearch, error) {
+	nmConfig, err := nm.ConfigList()
+	if err != nil {
+		return nil, err
+	}
+
+	var fromNotmuch []savedSearch
+
+	for key, val := range nmConfig {
+		if !strings.HasPrefix(key, "query.") {
+			continue
+		}
+
+		fromNotmuch = append(fromNotmuch, savedSearch{
+			Name:  strings.TrimPrefix(key, "query."),
+			Query: val,
+		})
+	}
+
+	sort.Slice(fromNotmuch, func(i, j int) bool {
+		return fromNotmuch[i].Name < fromNotmuch[j].Name
+	})
+
+	searches := append([]savedSearch(nil), _config.Searches...)
+
+	seen := make(map[string]bool)
+	for _, s := range searches {
+		seen[s.Name] = true
+	}
+
+	for _, s := range fromNotmuch {
+		if !seen[s.Name] {
+			searches = append(searches, s)
+		}
+	}
+
+	if len(searches) == 0 {
+		searches = append(searches, savedSearch{Name: "default", Query: _query})
+	}
+
+	return searches, nil
+}
+
+// counts returns a description of the number of unread and total messages matching s
+func (s savedSearch) counts(nm notmuch.Backend) string {
+	opts, query := parseQuery(s.Query)
+	countOpts := notmuch.CountOptions{IncludeExcluded: opts.all}
+
+	total, err := nm.Count(query, countOpts)
+	if err != nil {
+		return "(error: " + err.Error() + ")"
+	}
+
+	unread, err := nm.Count("("+query+") and tag:unread", countOpts)
+	if err != nil {
+		return "(error: " + err.Error() + ")"
+	}
+
+	return fmt.Sprintf("(%d/%d)", unread, total)
+}
+
+// indexLines returns the saved searches and the lines listing them in the index window
+func indexLines(nm notmuch.Backend) ([]savedSearch, []string, error) {
+	searches, err := savedSearches(nm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var lines []string
+	for _, s := range searches {
+		lines = append(lines, s.Name+"\t"+s.counts(nm)+"\t"+s.Query)
+	}
+
+	return searches, lines, nil
+}
+
+// refreshIndex lists the saved searches in win and returns them
+func refreshIndex(win *acme.Win, nm notmuch.Backend) ([]savedSearch, error) {
+	win.Clear()
+
+	searches, lines, err := indexLines(nm)
+	if err != nil {
+		win.Fprintf("data", "%s\n", describeError(err))
+		winClean(win)
+
+		return nil, err
+	}
+
+	win.PrintTabbed(strings.Join(lines, "\n"))
+
+	err = winClean(win)
+	if err != nil {
+		return nil, err
+	}
+
+	return searches, nil
+}
+
+// updateIndex updates the counts in the index window without clearing it. If the window was edited, it is left
+// alone. It returns the saved searches, or searches if the window wasn't updated.
+func updateIndex(win *acme.Win, nm notmuch.Backend, searches []savedSearch) ([]savedSearch, error) {
+	dirty, err := isDirty(win)
+	if err != nil || dirty {
+		return searches, err
+	}
+
+	s, lines, err := indexLines(nm)
+	if err != nil {
+		return searches, err
+	}
+
+	return s, replaceBody(win, formatTabbed(win, strings.Join(lines, "\n")))
+}
+
+// displayIndex opens the index window, which lists saved searches with the number of unread and total messages
+// for each of them. Looking at the name of a search opens its results.
+func displayIndex(wg *sync.WaitGroup, nm notmuch.Backend) error {
+	defer wg.Done()
+
+	reg := _windows.open("index", "")
+	if reg == nil {
+		// Already open
+		return nil
+	}
+	defer _windows.close(reg)
+
+	win, err := newWin("/Mail/index", "Get")
+	if err != nil {
+		return err
+	}
+
+	nm = warnTo(nm, win)
+
+	searches, err := refreshIndex(win, nm)
+	if err != nil {
+		win.Errf("can't list saved searches: %s", err)
+	}
+
+	sub := _bus.subscribe()
+	defer _bus.cancel(sub)
+
+	events := win.EventChan()
+
+	for {
+		var evt *acme.Event
+
+		select {
+		case e := <-sub.C:
+			switch e.(type) {
+			case tagEvent, dbChanged:
+			default:
+				continue
+			}
+
+			// Any change of tags or the database may change the counts
+			searches, err = updateIndex(win, nm, searches)
+			if err != nil {
+				win.Errf("can't update index: %s", err)
+			}
+
+			continue
+		case <-reg.Raise:
+			err = win.Ctl("show")
+			if err == nil {
+				searches, err = updateIndex(win, nm, searches)
+			}
+
+			if err != nil {
+				win.Errf("can't update index: %s", err)
+			}
+
+			continue
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+
+			evt = ev
+		}
+
+		switch evt.C2 {
+		case 'l', 'L':
+		case 'x', 'X':
+			if string(evt.Text) == "Get" {
+				searches, err = refreshIndex(win, nm)
+				if err != nil {
+					win.Errf("can't refresh index: %s", err)
+				}
+
+				continue
+			}
+
+			err := handleCommand(wg, nm, win, evt)
+			switch err {
+			case nil:
+				// Nothing to do, event already handled
+			case errNotACommand:
+				// Let ACME handle the event
+				err := win.WriteEvent(evt)
+				if err != nil {
+					return err
+				}
+			}
+
+			continue
+		default:
+			continue
+		}
+
+		// Short message IDs from other windows
+		if look(wg, nm, string(evt.Text), "") == nil {
+			continue
+		}
+
+		name := strings.TrimSpace(string(evt.Text))
+
+		found := false
+		for _, s := range searches {
+			if s.Name != name {
+				continue
+			}
+
+			found = true
+
+			wg.Add(1)
+			go func(query string) {
+				err := displayQueryResult(wg, nm, query)
+				if err != nil {
+					win.Errf("can't display query results for %q: %s", query, err)
+				}
+			}(s.Query)
+
+			break
+		}
+
+		if !found {
+			// Not the name of a saved search, send it back to ACME
+			err := win.WriteEvent(evt)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
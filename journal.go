@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tagChange is the change of tags of a single message
+type tagChange struct {
+	ID     string   // Message ID
+	Before []string // Sorted tags before the change
+	After  []string // Sorted tags after the change
+}
+
+// ops returns the tag changes (+tag, -tag) that turn the tags from before into after
+func (c tagChange) ops() []string {
+	var ops []string
+
+	before := make(map[string]bool)
+	for _, t := range c.Before {
+		before[t] = true
+	}
+
+	after := make(map[string]bool)
+	for _, t := range c.After {
+		after[t] = true
+
+		if !before[t] {
+			ops = append(ops, "+"+t)
+		}
+	}
+
+	for _, t := range c.Before {
+		if !after[t] {
+			ops = append(ops, "-"+t)
+		}
+	}
+
+	return ops
+}
+
+// reverse returns the change that undoes c
+func (c tagChange) reverse() tagChange {
+	return tagChange{ID: c.ID, Before: c.After, After: c.Before}
+}
+
+// journalEntry is a line of the journal. Entries are grouped by the action that caused them, e.g. all messages
+// of a thread that was tagged at once.
+type journalEntry struct {
+	Group int64     `json:"group"`
+	Time  time.Time `json:"time"`
+
+	// Either a change of tags...
+	tagChange
+
+	// ... or a note that an earlier group was undone
+	Undoes int64 `json:"undoes,omitempty"`
+}
+
+func (e journalEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Group  int64     `json:"group"`
+		Time   time.Time `json:"time"`
+		ID     string    `json:"id,omitempty"`
+		Before []string  `json:"before,omitempty"`
+		After  []string  `json:"after,omitempty"`
+		Undoes int64     `json:"undoes,omitempty"`
+	}{e.Group, e.Time, e.ID, e.Before, e.After, e.Undoes})
+}
+
+func (e *journalEntry) UnmarshalJSON(data []byte) error {
+	var dup struct {
+		Group  int64     `json:"group"`
+		Time   time.Time `json:"time"`
+		ID     string    `json:"id"`
+		Before []string  `json:"before"`
+		After  []string  `json:"after"`
+		Undoes int64     `json:"undoes"`
+	}
+
+	err := json.Unmarshal(data, &dup)
+	if err != nil {
+		return err
+	}
+
+	*e = journalEntry{
+		Group:     dup.Group,
+		Time:      dup.Time,
+		tagChange: tagChange{ID: dup.ID, Before: dup.Before, After: dup.After},
+		Undoes:    dup.Undoes,
+	}
+
+	return nil
+}
+
+// _journalKeep is the number of entries kept when the journal is compacted. It is compacted when it is opened and
+// has grown to twice this size.
+const _journalKeep = 5000
+
+// journal records changes of tags, so that they can be undone. It is safe for concurrent use.
+type journal struct {
+	mu      sync.Mutex
+	path    string // Where entries are persisted, may be empty
+	entries []journalEntry
+	next    int64 // Next group ID
+}
+
+var _journal = &journal{next: 1}
+
+// defaultJournalPath returns $XDG_DATA_HOME/acme-notmuch/journal, falling back to ~/.local/share if XDG_DATA_HOME
+// is not set
+func defaultJournalPath() string {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+
+		dir = filepath.Join(home, ".local", "share")
+	}
+
+	return filepath.Join(dir, "acme-notmuch", "journal")
+}
+
+// openJournal reads the journal at path. A missing file results in an empty journal.
+func openJournal(path string) (*journal, error) {
+	j := &journal{
+		path: path,
+		next: 1,
+	}
+
+	if path == "" {
+		return j, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return j, nil
+		}
+
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		var e journalEntry
+
+		err = json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+
+		j.entries = append(j.entries, e)
+
+		if e.Group >= j.next {
+			j.next = e.Group + 1
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(j.entries) > 2*_journalKeep {
+		j.entries = j.entries[len(j.entries)-_journalKeep:]
+
+		err = j.rewrite()
+		if err != nil {
+			return nil, fmt.Errorf("compacting journal: %w", err)
+		}
+	}
+
+	return j, nil
+}
+
+// rewrite replaces the journal file with the current entries
+func (j *journal) rewrite() error {
+	tmp := j.path + ".new"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	for _, e := range j.entries {
+		err = enc.Encode(e)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, j.path)
+}
+
+// append adds entries to the journal and persists them
+func (j *journal) append(entries []journalEntry) error {
+	j.entries = append(j.entries, entries...)
+
+	if j.path == "" {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(j.path), 0700)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	for _, e := range entries {
+		err = enc.Encode(e)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+// record adds changes to the journal as a new group. If undoes isn't 0, the group is marked as undoing the
+// group with that ID. It returns the ID of the new group.
+func (j *journal) record(changes []tagChange, undoes int64) (int64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	group := j.next
+	j.next++
+
+	now := time.Now()
+
+	var entries []journalEntry
+	for _, c := range changes {
+		entries = append(entries, journalEntry{Group: group, Time: now, tagChange: c})
+	}
+
+	if undoes != 0 {
+		entries = append(entries, journalEntry{Group: group, Time: now, Undoes: undoes})
+	}
+
+	return group, j.append(entries)
+}
+
+// changes returns the changes of the given group
+func (j *journal) changes(group int64) []tagChange {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var res []tagChange
+
+	for _, e := range j.entries {
+		if e.Group == group && e.ID != "" {
+			res = append(res, e.tagChange)
+		}
+	}
+
+	return res
+}
+
+// undoable returns the IDs of the last n groups, newest first, that have neither been undone nor are undoing
+// another group themselves
+func (j *journal) undoable(n int) []int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	skip := make(map[int64]bool)
+
+	for _, e := range j.entries {
+		if e.Undoes != 0 {
+			skip[e.Group] = true
+			skip[e.Undoes] = true
+		}
+	}
+
+	var (
+		res  []int64
+		seen = make(map[int64]bool)
+	)
+
+	for idx := len(j.entries) - 1; idx >= 0 && len(res) < n; idx-- {
+		g := j.entries[idx].Group
+		if skip[g] || seen[g] {
+			continue
+		}
+
+		seen[g] = true
+		res = append(res, g)
+	}
+
+	return res
+}
+
+// journalGroup summarizes a group of journal entries
+type journalGroup struct {
+	ID      int64
+	Time    time.Time
+	Changes []tagChange
+	Undoes  int64 // ID of the group this group undid, if any
+	Undone  bool  // Set if the group was undone later
+}
+
+// recent returns the last n groups, newest first
+func (j *journal) recent(n int) []journalGroup {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var (
+		res    []journalGroup
+		index  = make(map[int64]int)
+		undone = make(map[int64]bool)
+	)
+
+	for _, e := range j.entries {
+		if e.Undoes != 0 {
+			undone[e.Undoes] = true
+		}
+	}
+
+	for idx := len(j.entries) - 1; idx >= 0; idx-- {
+		e := j.entries[idx]
+
+		pos, ok := index[e.Group]
+		if !ok {
+			if len(res) == n {
+				continue
+			}
+
+			pos = len(res)
+			index[e.Group] = pos
+			res = append(res, journalGroup{ID: e.Group, Time: e.Time, Undone: undone[e.Group]})
+		}
+
+		if e.Undoes != 0 {
+			res[pos].Undoes = e.Undoes
+		} else {
+			// Entries are visited backwards, so prepend to keep the original order
+			res[pos].Changes = append([]tagChange{e.tagChange}, res[pos].Changes...)
+		}
+	}
+
+	return res
+}
+
+// String renders g as a line for the history window
+func (g journalGroup) String() string {
+	var desc []string
+
+	// Summarize identical changes, e.g. all messages of a thread losing their "unread" tag
+	counts := make(map[string]int)
+	var order []string
+
+	for _, c := range g.Changes {
+		ops := strings.Join(c.ops(), " ")
+		if counts[ops] == 0 {
+			order = append(order, ops)
+		}
+
+		counts[ops]++
+	}
+
+	for _, ops := range order {
+		if ops == "" {
+			ops = "(no change)"
+		}
+
+		desc = append(desc, fmt.Sprintf("%s on %d", ops, counts[ops]))
+	}
+
+	var ids []string
+	for idx, c := range g.Changes {
+		if idx == 3 {
+			ids = append(ids, "...")
+			break
+		}
+
+		ids = append(ids, c.ID)
+	}
+
+	line := fmt.Sprintf("#%d\t%s\t%s\t%s", g.ID, g.Time.Format("2006-01-02 15:04"), strings.Join(desc, ", "), strings.Join(ids, " "))
+
+	if g.Undoes != 0 {
+		line += fmt.Sprintf("\t(undoes #%d)", g.Undoes)
+	}
+
+	if g.Undone {
+		line += "\t(undone)"
+	}
+
+	return line
+}
+
+var errNothingToUndo = errors.New("nothing to undo")
+
+// sortedTags returns the keys of tags in sorted order
+func sortedTags(tags map[string]bool) []string {
+	res := make([]string, 0, len(tags))
+	for t := range tags {
+		res = append(res, t)
+	}
+
+	sort.Strings(res)
+
+	return res
+}
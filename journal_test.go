@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUndo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "journal")
+
+	fake, restore := setupTagTest(t)
+	defer restore()
+
+	_journal, err = openJournal(path)
+	require.NoError(t, err)
+
+	count := func(query string) int { return countMessages(t, fake, query) }
+
+	require.NoError(t, tagEach(fake, []string{"-unread", "+read"}, []string{"thread:0000000000000001"}))
+	require.NoError(t, tagEach(fake, []string{"-inbox"}, []string{"id:lunch@example.com"}))
+
+	assert.Equal(t, 1, count("tag:unread"))
+	assert.Equal(t, 4, count("tag:read"))
+
+	groups := _journal.recent(10)
+	require.Len(t, groups, 2)
+	assert.Len(t, groups[0].Changes, 1)
+	// root@ wasn't unread before, so only three messages lost the tag
+	assert.Equal(t, []tagChange{
+		{ID: "root@example.com", Before: []string{"inbox"}, After: []string{"inbox", "read"}},
+		{ID: "reply1@example.com", Before: []string{"inbox", "unread"}, After: []string{"inbox", "read"}},
+	}, groups[1].Changes[:2])
+
+	// Tags changed since then are kept
+	require.NoError(t, fake.Tag([]string{"+flagged"}, "id:root@example.com"))
+
+	require.NoError(t, undo(fake, 2))
+
+	assert.Equal(t, 4, count("tag:unread"))
+	assert.Equal(t, 0, count("tag:read"))
+	assert.Equal(t, 5, count("tag:inbox"))
+	assert.Equal(t, 1, count("tag:flagged"))
+
+	assert.Equal(t, errNothingToUndo, undo(fake, 1))
+
+	// The journal survives a restart
+	_journal, err = openJournal(path)
+	require.NoError(t, err)
+
+	groups = _journal.recent(10)
+	require.Len(t, groups, 4)
+	assert.True(t, groups[2].Undone)
+	assert.Equal(t, groups[3].ID, groups[0].Undoes)
+	assert.Empty(t, _journal.undoable(10))
+}
+
+func TestUndoDelete(t *testing.T) {
+	fake, restore := setupTagTest(t)
+	defer restore()
+
+	fake.SetConfig("search.exclude_tags", "deleted")
+
+	count := func(query string) int { return countMessages(t, fake, query) }
+
+	require.NoError(t, tagEach(fake, _config.Delete.Tags, []string{"id:lunch@example.com"}))
+	assert.Equal(t, 1, count("tag:deleted"))
+
+	// Deleted messages are excluded from searches, but can still be undeleted
+	require.NoError(t, undo(fake, 1))
+	assert.Equal(t, 1, count("id:lunch@example.com and tag:inbox and tag:unread and not tag:deleted"))
+
+	require.NoError(t, tagEach(fake, []string{"+deleted"}, []string{"id:lunch@example.com"}))
+	require.NoError(t, tagEach(fake, []string{"-deleted"}, []string{"id:lunch@example.com"}))
+	assert.Equal(t, 0, count("tag:deleted"))
+}
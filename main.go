@@ -25,18 +25,45 @@ import (
 	"errors"
 	"flag"
 	"log"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 
 	"9fans.net/go/acme"
+
+	"github.com/farhaven/acme-notmuch/notmuch"
 )
 
 var (
-	_query string
+	_query       string
+	_fake        string
+	_configPath  string
+	_journalPath string
+	_stripMuted  bool
 )
 
 func init() {
-	flag.StringVar(&_query, "query", "tag:unread and not tag:openbsd", "initial query")
+	flag.StringVar(&_configPath, "config", defaultConfigPath(), "configuration file")
+	flag.StringVar(&_journalPath, "journal", defaultJournalPath(), "file that tag changes are recorded in, so that they can be undone")
+	flag.BoolVar(&_stripMuted, "strip-muted", false, "update the tags of new messages in muted threads and exit, e.g. from notmuch's post-new hook")
+	flag.StringVar(&_query, "query", "tag:unread and not tag:openbsd", "query shown in the index if notmuch has no saved searches, may start with options like -oldest or -all")
+	flag.StringVar(&_fake, "fake", "", "use threads from this JSON file (as produced by `notmuch show --format=json`) instead of the notmuch database")
+}
+
+// newBackend returns the backend selected on the command line
+func newBackend() (notmuch.Backend, error) {
+	if _fake == "" {
+		return &notmuch.CLI{}, nil
+	}
+
+	f, err := os.Open(_fake)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return notmuch.LoadFake(f)
 }
 
 func newWin(name, tag string) (*acme.Win, error) {
@@ -83,6 +110,110 @@ func winClean(win *acme.Win) error {
 	return nil
 }
 
+// describeError returns the text of err, followed by a hint on how to resolve it if err is a known notmuch failure
+func describeError(err error) string {
+	var nmErr *notmuch.Error
+	if !errors.As(err, &nmErr) {
+		return err.Error()
+	}
+
+	var hint string
+
+	switch nmErr.Kind {
+	case notmuch.ErrQuerySyntax:
+		hint = "Check the query, see notmuch-search-terms(7) for the syntax."
+	case notmuch.ErrDatabaseLocked:
+		hint = "Another process (notmuch new?) is writing to the database. Try again with Get once it is done."
+	case notmuch.ErrDatabaseMissing:
+		hint = "No notmuch database found. Run `notmuch setup` and `notmuch new` first."
+	case notmuch.ErrBinaryMissing:
+		hint = "The notmuch command was not found. Make sure it is installed and in $PATH."
+	default:
+		return err.Error()
+	}
+
+	return err.Error() + "\n" + hint
+}
+
+// warnTo returns a copy of nm that reports notmuch warnings in win's error window
+func warnTo(nm notmuch.Backend, win *acme.Win) notmuch.Backend {
+	return notmuch.WithWarnings(nm, func(warning string) {
+		win.Errf("notmuch: %s", warning)
+	})
+}
+
+// dot returns the character offsets of the start and end of win's dot
+func dot(win *acme.Win) (int, int, error) {
+	// Acme resets the address when the addr file is opened, so make sure that it is open before setting it
+	_, _, err := win.ReadAddr()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = win.Ctl("addr=dot")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return win.ReadAddr()
+}
+
+// setDot sets win's dot to the characters from q0 to q1 and makes sure that it is visible. If that range doesn't
+// exist anymore, dot is set to the end of the body.
+func setDot(win *acme.Win, q0, q1 int) error {
+	err := win.Addr("#%d,#%d", q0, q1)
+	if err != nil {
+		err = win.Addr("$")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = win.Ctl("dot=addr")
+	if err != nil {
+		return err
+	}
+
+	return win.Ctl("show")
+}
+
+// selectedLines returns the complete lines of win's body that are touched by dot
+func selectedLines(win *acme.Win) ([]string, error) {
+	q0, q1, err := dot(win)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := win.ReadAll("body")
+	if err != nil {
+		return nil, err
+	}
+
+	runes := []rune(string(body))
+	if q1 > len(runes) {
+		q1 = len(runes)
+	}
+
+	if q0 > q1 {
+		q0 = q1
+	}
+
+	// A selection of whole lines ends just after the last newline, don't include the line after that
+	if q1 > q0 && runes[q1-1] == '\n' {
+		q1--
+	}
+
+	for q0 > 0 && runes[q0-1] != '\n' {
+		q0--
+	}
+
+	for q1 < len(runes) && runes[q1] != '\n' {
+		q1++
+	}
+
+	return strings.Split(string(runes[q0:q1]), "\n"), nil
+}
+
 var errNotACommand = errors.New("not a command event")
 
 func getCommandArgs(evt *acme.Event) (string, string) {
@@ -104,7 +235,7 @@ func getCommandArgs(evt *acme.Event) (string, string) {
 	return cmd, arg
 }
 
-func handleCommand(wg *sync.WaitGroup, win *acme.Win, evt *acme.Event) error {
+func handleCommand(wg *sync.WaitGroup, nm notmuch.Backend, win *acme.Win, evt *acme.Event) error {
 	cmd, arg := getCommandArgs(evt)
 
 	switch {
@@ -112,7 +243,7 @@ func handleCommand(wg *sync.WaitGroup, win *acme.Win, evt *acme.Event) error {
 		wg.Add(1)
 
 		go func() {
-			err := displayQueryResult(wg, arg)
+			err := displayQueryResult(wg, nm, arg)
 			if err != nil {
 				win.Errf("can't display query results for %q: %s", arg, err)
 			}
@@ -120,8 +251,44 @@ func handleCommand(wg *sync.WaitGroup, win *acme.Win, evt *acme.Event) error {
 
 		return nil
 	case cmd == "Compose":
+		text, err := newMessageText()
+		if err != nil {
+			win.Errf("%s", err)
+		}
+
+		wg.Add(1)
+		go composeMessage(wg, nm, text)
+
+		return nil
+	case cmd == "Undo":
+		n := 1
+		if arg != "" {
+			var err error
+
+			n, err = strconv.Atoi(arg)
+			if err != nil || n <= 0 {
+				win.Errf("Undo: %q is not a positive number", arg)
+				return nil
+			}
+		}
+
+		err := undo(nm, n)
+		if err != nil {
+			win.Errf("can't undo: %s", describeError(err))
+		}
+
+		return nil
+	case cmd == "History":
 		wg.Add(1)
-		go composeMessage(wg, newMailTemplate)
+
+		go func() {
+			err := displayHistory(wg, nm)
+			if err != nil {
+				win.Errf("can't display history: %s", err)
+			}
+		}()
+
+		return nil
 	}
 
 	return errNotACommand
@@ -130,12 +297,43 @@ func handleCommand(wg *sync.WaitGroup, win *acme.Win, evt *acme.Event) error {
 func main() {
 	flag.Parse()
 
+	var err error
+
+	_config, err = loadConfig(_configPath)
+	if err != nil {
+		log.Fatalf("can't load configuration:\n%s", err)
+	}
+
+	_journal, err = openJournal(_journalPath)
+	if err != nil {
+		log.Printf("can't open journal, tag changes won't be saved: %s", err)
+		_journal, _ = openJournal("")
+	}
+
+	nm, err := newBackend()
+	if err != nil {
+		log.Fatalf("can't open mail store: %s", err)
+	}
+
+	if _stripMuted {
+		err = stripMuted(nm)
+		if err != nil {
+			log.Fatalf("can't update muted threads: %s", describeError(err))
+		}
+
+		return
+	}
+
+	if _config.Watch.Interval > 0 {
+		go watchDatabase(nm, _config.Watch.Interval)
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(1)
 
-	err := displayQueryResult(&wg, _query)
+	err = displayIndex(&wg, nm)
 	if err != nil {
-		log.Panicf("can't run query: %s", err)
+		log.Panicf("can't show index: %s", err)
 	}
 
 	wg.Wait()
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"mime"
 	"net/mail"
-	"os/exec"
 	"strings"
 	"sync"
 	"time"
@@ -14,104 +16,261 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/farhaven/acme-notmuch/message"
+	"github.com/farhaven/acme-notmuch/notmuch"
 )
 
-// Set to false to disable removal of "unread" tag on message open
-const _removeUnreadTag = true
+// tagMessage applies the tag changes in tags to the message with the given ID
+func tagMessage(nm notmuch.Backend, tags string, messageID string) error {
+	err := tagEach(nm, strings.Fields(tags), []string{"id:" + messageID})
+	if err != nil {
+		return fmt.Errorf("can't set tags: %w", err)
+	}
+
+	return nil
+}
 
-func tagMessage(tags string, messageID string) error {
-	args := []string{
-		"tag",
+// messageSteps maps the message window commands for moving to another message to the direction they move in, and
+// whether they skip read messages
+var messageSteps = map[string]struct {
+	forward bool
+	unread  bool
+}{
+	"Next":    {forward: true, unread: true},
+	"Prev":    {forward: false, unread: true},
+	"NextAny": {forward: true, unread: false},
+	"PrevAny": {forward: false, unread: false},
+}
+
+// nextInThread returns the ID of the message after the one with the given ID in thread, or before it if forward is
+// false. An empty id starts at the first (or last) message. Read messages are skipped if unread is set. If there is no
+// such message, "" is returned.
+func nextInThread(thread Thread, id string, forward, unread bool) (string, error) {
+	var msgs []*ThreadMessage
+	for _, n := range thread.PreOrder() {
+		if n.Message != nil {
+			msgs = append(msgs, n.Message)
+		}
 	}
 
-	args = append(args, strings.Fields(tags)...)
+	if !forward {
+		for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+			msgs[i], msgs[j] = msgs[j], msgs[i]
+		}
+	}
 
-	args = append(args, []string{
-		"--",
-		"id:" + messageID,
-	}...)
+	found := id == ""
+	for _, msg := range msgs {
+		if msg.ID == id {
+			found = true
+			continue
+		}
 
-	cmd := exec.Command("notmuch", args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("can't set tags: %q, %w", output, err)
+		if !found {
+			continue
+		}
+
+		if !unread || msg.TagSet().Tags["unread"] {
+			return msg.ID, nil
+		}
 	}
 
-	return nil
+	if !found {
+		return "", errors.New("current message not found in thread")
+	}
+
+	return "", nil
 }
 
-// nextUnread returns the message ID of the next unread message in the same thread as id
-func nextUnread(wg *sync.WaitGroup, win *acme.Win, id string) error {
-	// TODO: Handle multiple threads?
+// nextMessage returns the ID of the next message after the one with the given ID in its thread, or of the previous
+// one if forward is false. Read messages are skipped if unread is set. If origin is the query of the window that the
+// message was opened from and its thread has no more messages, the search continues in the next threads listed
+// there.
+func nextMessage(nm notmuch.Backend, id, origin string, forward, unread bool) (string, error) {
+	threadID, err := threadOf(nm, id)
+	if err != nil {
+		return "", err
+	}
 
-	cmd := exec.Command("notmuch", "search", "--format=json", "--output=threads", "id:"+id)
-	output, err := cmd.CombinedOutput()
+	thread, err := loadThread(nm, threadID, "")
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	next, err := nextInThread(thread, id, forward, unread)
+	if err != nil || next != "" {
+		return next, err
+	}
+
+	errNone := errors.New("no next message found")
+	if !forward {
+		errNone = errors.New("no previous message found")
+	}
+
+	if origin == "" {
+		return "", errNone
 	}
 
-	var threadIDs []string
-	err = json.Unmarshal(output, &threadIDs)
+	opts, query := parseQuery(origin)
+	if query == "" {
+		query = "*"
+	}
+
+	searchOpts := opts.searchOptions()
+	searchOpts.Output = "summary"
+
+	// The thread may not match the query anymore, e.g. because it was just read
+	candidates, err := threadsAround(nm, "("+query+") or thread:"+threadID, searchOpts, threadID, forward, unread)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if len(threadIDs) == 0 {
-		return errors.New("can't find thread for message")
-	} else if len(threadIDs) > 1 {
-		return errors.New("more than one thread id for message")
+	for _, candidate := range candidates {
+		thread, err := loadThread(nm, candidate, "")
+		if err != nil {
+			return "", err
+		}
+
+		next, err := nextInThread(thread, "", forward, unread)
+		if err != nil || next != "" {
+			return next, err
+		}
 	}
 
-	// Get thread for the message
-	cmd = exec.Command("notmuch", "show", "--format=json", "--body=false", "thread:"+threadIDs[0])
-	output, err = cmd.CombinedOutput()
+	return "", errNone
+}
+
+// threadsAround returns the IDs of the threads that are listed after the one with the given ID in the results of
+// query, nearest first, or those listed before it if forward is false. Threads without unread messages are skipped if
+// unread is set. The results are read only until the first following thread is found.
+func threadsAround(nm notmuch.Backend, query string, opts notmuch.SearchOptions, threadID string, forward,
+	unread bool) ([]string, error) {
+	r, err := nm.Search(query, opts)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	threads, err := scanThreadsAround(r, threadID, forward, unread)
+
+	closeErr := r.Close()
+	if closeErr != nil {
+		return nil, closeErr
 	}
 
-	var thread Thread
-	err = json.Unmarshal(output, &thread)
+	return threads, err
+}
+
+// scanThreadsAround reads search results from r until the threads that threadsAround returns are known
+func scanThreadsAround(r io.Reader, threadID string, forward, unread bool) ([]string, error) {
+	dec := json.NewDecoder(r)
+
+	_, err := dec.Token()
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("reading start of results: %w", err)
 	}
 
-	l := thread.PreOrder()
+	var (
+		before []string
+		found  bool
+	)
+
+	for dec.More() {
+		var res QueryResult
+
+		err = dec.Decode(&res)
+		if err != nil {
+			return nil, fmt.Errorf("decoding result: %w", err)
+		}
+
+		if res.Thread == threadID {
+			found = true
+
+			if !forward {
+				break
+			}
 
-	foundThisMsg := false
-	foundNextMsg := false
-	for _, entry := range l {
-		if entry.MsgID == id {
-			foundThisMsg = true
 			continue
 		}
 
-		if !foundThisMsg {
+		if unread && !(ThreadMessage{Tags: res.Tags}).TagSet().Tags["unread"] {
 			continue
 		}
 
-		if entry.Tags["unread"] {
-			wg.Add(1)
-			go displayMessage(wg, entry.MsgID)
-			foundNextMsg = true
-			break
+		if found {
+			return []string{res.Thread}, nil
+		}
+
+		if !forward {
+			before = append(before, res.Thread)
 		}
 	}
 
-	if !foundThisMsg {
-		return errors.New("current message not found in thread")
+	if !found {
+		return nil, nil
 	}
 
-	if !foundNextMsg {
-		return errors.New("no next message found")
+	// Nearest first
+	for i, j := 0, len(before)-1; i < j; i, j = i+1, j-1 {
+		before[i], before[j] = before[j], before[i]
+	}
+
+	return before, nil
+}
+
+// openNext opens the message found by nextMessage in a new window
+func openNext(wg *sync.WaitGroup, nm notmuch.Backend, id, origin string, forward, unread bool) error {
+	next, err := nextMessage(nm, id, origin, forward, unread)
+	if err != nil {
+		return err
 	}
 
+	wg.Add(1)
+	go displayMessage(wg, nm, next, origin)
+
 	return nil
 }
 
-func getAllHeaders(root message.Root) (mail.Header, error) {
-	cmd := exec.Command("notmuch", "show", "--format=raw", "id:"+root.ID)
+// treeNeighbours maps the message window commands for moving through the reply tree to the related message
+var treeNeighbours = map[string]func(Thread, *Node) *Node{
+	"Parent": func(_ Thread, n *Node) *Node {
+		return n.Parent
+	},
+	"FirstChild": func(_ Thread, n *Node) *Node {
+		return n.FirstChild()
+	},
+	"NextSibling": Thread.NextSibling,
+	"PrevSibling": Thread.PrevSibling,
+}
+
+// openRelated opens the message that is related to the message with the given ID by rel
+func openRelated(wg *sync.WaitGroup, nm notmuch.Backend, id, origin string, rel func(Thread, *Node) *Node) error {
+	threadID, err := threadOf(nm, id)
+	if err != nil {
+		return err
+	}
+
+	thread, err := loadThread(nm, threadID, "")
+	if err != nil {
+		return err
+	}
+
+	node := thread.Find(id)
+	if node == nil {
+		return errors.New("current message not found in thread")
+	}
+
+	target := rel(thread, node)
+	if target == nil || target.Message == nil {
+		return errors.New("no such message")
+	}
+
+	wg.Add(1)
+	go displayMessage(wg, nm, target.Message.ID, origin)
 
-	output, err := cmd.CombinedOutput()
+	return nil
+}
+
+func getAllHeaders(nm notmuch.Backend, root message.Root) (mail.Header, error) {
+	output, err := nm.ShowRaw(root.ID)
 	if err != nil {
 		return nil, err
 	}
@@ -128,51 +287,53 @@ func getAllHeaders(root message.Root) (mail.Header, error) {
 	return msg.Header, nil
 }
 
-func writeMessageHeaders(win *acme.Win, msg message.Root) error {
-	allHeaders, err := getAllHeaders(msg)
+// formatMessageHeaders returns the header block at the top of message windows, with the headers in hdrs
+func formatMessageHeaders(win *acme.Win, nm notmuch.Backend, msg message.Root, hdrs []string) (string, error) {
+	allHeaders, err := getAllHeaders(nm, msg)
 	if err != nil {
-		return errors.Wrap(err, "getting headers")
+		return "", errors.Wrap(err, "getting headers")
 	}
 
 	var errs []error
 
-	date, err := allHeaders.Date()
-	if err != nil {
-		errs = append(errs, fmt.Errorf("can't read date: %w", err))
-		date = time.Unix(0, 0)
-	}
+	var headers []string
 
-	headers := []string{"Date:\t" + date.Format(time.RFC3339)}
-
-	addrHeaders := []string{"from", "to", "cc", "bcc"}
-	for _, hdr := range addrHeaders {
-		addrs, err := allHeaders.AddressList(hdr)
-		if err != nil {
-			if err == mail.ErrHeaderNotPresent {
-				continue
+	for _, hdr := range hdrs {
+		switch hdr {
+		case "date":
+			date, err := allHeaders.Date()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("can't read date: %w", err))
+				date = time.Unix(0, 0)
 			}
 
-			return errors.Wrap(err, "reading address header")
-		}
+			headers = append(headers, "Date:\t"+date.Format(time.RFC3339))
+		case "from", "to", "cc", "bcc":
+			addrs, err := allHeaders.AddressList(hdr)
+			if err != nil {
+				if err == mail.ErrHeaderNotPresent {
+					continue
+				}
 
-		var vals []string
+				return "", errors.Wrap(err, "reading address header")
+			}
 
-		for _, addr := range addrs {
-			vals = append(vals, addr.String())
-		}
+			var vals []string
 
-		headers = append(headers, strings.Title(hdr)+":\t"+strings.Join(vals, ", "))
-	}
+			for _, addr := range addrs {
+				vals = append(vals, addr.String())
+			}
 
-	moreHeaders := []string{"reply-to", "list-id", "x-bogosity", "content-type", "subject", "tags"}
-	for _, hdr := range moreHeaders {
-		val := allHeaders.Get(hdr)
+			headers = append(headers, strings.Title(hdr)+":\t"+strings.Join(vals, ", "))
+		default:
+			val := allHeaders.Get(hdr)
 
-		if val == "" {
-			continue
-		}
+			if val == "" {
+				continue
+			}
 
-		headers = append(headers, strings.Title(hdr)+":\t"+val)
+			headers = append(headers, strings.Title(hdr)+":\t"+val)
+		}
 	}
 
 	crypto := msg.Crypto.Render("\t")
@@ -180,47 +341,139 @@ func writeMessageHeaders(win *acme.Win, msg message.Root) error {
 		headers = append(headers, "Crypto:"+crypto)
 	}
 
+	var text strings.Builder
+
 	if len(errs) != 0 {
-		err = win.Fprintf("body", "Errors during processing:\n")
-		if err != nil {
-			return errors.Wrap(err, "writing to window")
-		}
+		text.WriteString("Errors during processing:\n")
 		for _, err := range errs {
-			err = win.Fprintf("body", "%s\n", err.Error())
-			if err != nil {
-				return errors.Wrap(err, "writing to window")
+			text.WriteString(err.Error() + "\n")
+		}
+	}
+
+	text.WriteString(formatTabbed(win, strings.Join(headers, "\n")))
+
+	return text.String(), nil
+}
+
+// headerField is a header of a message
+type headerField struct {
+	Name  string
+	Value string
+}
+
+// parseHeaderFields returns the headers of the raw message in the order they appear in, including repeated ones
+// like Received. Folded lines are joined and encoded words are decoded.
+func parseHeaderFields(raw []byte) []headerField {
+	var (
+		fields []headerField
+		dec    mime.WordDecoder
+	)
+
+	for _, line := range strings.Split(strings.ReplaceAll(string(raw), "\r\n", "\n"), "\n") {
+		if line == "" {
+			// End of the header section
+			break
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(fields) != 0 {
+				fields[len(fields)-1].Value += " " + strings.TrimSpace(line)
 			}
+
+			continue
 		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			// Not a header, e.g. the mbox From_ line
+			continue
+		}
+
+		fields = append(fields, headerField{Name: parts[0], Value: strings.TrimSpace(parts[1])})
 	}
 
-	win.PrintTabbed(strings.Join(headers, "\n"))
+	for idx, f := range fields {
+		val, err := dec.DecodeHeader(f.Value)
+		if err == nil {
+			f.Value = val
+		}
 
-	return nil
+		// Tabs would break the alignment of the header block
+		fields[idx].Value = strings.ReplaceAll(f.Value, "\t", " ")
+	}
+
+	return fields
 }
 
-func refreshMessage(messageID string, win *acme.Win) error {
-	// TODO: Decode PGP
-	cmd := exec.Command("notmuch", "show", "--decrypt=true", "--format=json", "--entire-thread=false", "--include-html", "id:"+messageID)
+// formatAllHeaders returns a header block with all headers of msg, in their original order
+func formatAllHeaders(win *acme.Win, nm notmuch.Backend, msg message.Root) (string, error) {
+	raw, err := nm.ShowRaw(msg.ID)
+	if err != nil {
+		return "", err
+	}
+
+	var headers []string
+
+	for _, f := range parseHeaderFields(raw) {
+		headers = append(headers, f.Name+":\t"+f.Value)
+	}
+
+	headers = append(headers, "Tags:\t"+strings.Join(msg.Tags, ", "))
 
-	output, err := cmd.Output()
+	return formatTabbed(win, strings.Join(headers, "\n")), nil
+}
+
+// loadMessage returns the message with the given ID, including its body
+func loadMessage(nm notmuch.Backend, messageID string) (message.Root, error) {
+	// TODO: Decode PGP
+	output, err := nm.Show("id:"+messageID, notmuch.ShowOptions{Body: true, IncludeHTML: true, Decrypt: true})
 	if err != nil {
-		return fmt.Errorf("loading payload: %w", err)
+		return message.Root{}, fmt.Errorf("loading payload: %w", err)
 	}
 
 	var msg message.Root
 	err = json.Unmarshal(output, &msg)
 	if err != nil {
-		return fmt.Errorf("decoding message: raw=%s %w", output, err)
+		return message.Root{}, fmt.Errorf("decoding message: raw=%s %w", output, err)
 	}
 
-	win.Clear()
+	return msg, nil
+}
 
-	err = writeMessageHeaders(win, msg)
+// renderMessage returns the text of the message window for the message with the given ID. If allHeaders is set, all
+// headers of the message are shown instead of the configured ones.
+func renderMessage(win *acme.Win, nm notmuch.Backend, messageID string, allHeaders bool) (string, error) {
+	msg, err := loadMessage(nm, messageID)
 	if err != nil {
-		return fmt.Errorf("writing headers for %q: %w", messageID, err)
+		return "", err
+	}
+
+	var headers string
+	if allHeaders {
+		headers, err = formatAllHeaders(win, nm, msg)
+	} else {
+		headers, err = formatMessageHeaders(win, nm, msg, _config.Message.Headers)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("writing headers for %q: %w", messageID, err)
+	}
+
+	return headers + "\n" + msg.Render(), nil
+}
+
+func refreshMessage(nm notmuch.Backend, messageID string, win *acme.Win) error {
+	text, err := renderMessage(win, nm, messageID, false)
+	if err != nil {
+		win.Fprintf("data", "\n%s\n", describeError(err))
+		winClean(win)
+
+		return err
 	}
 
-	err = win.Fprintf("body", "\n%s", msg.Render())
+	win.Clear()
+
+	err = win.Fprintf("body", "%s", text)
 	if err != nil {
 		return fmt.Errorf("writing message body: %w", err)
 	}
@@ -233,42 +486,127 @@ func refreshMessage(messageID string, win *acme.Win) error {
 	return nil
 }
 
-func displayMessage(wg *sync.WaitGroup, messageID string) {
+// updateMessage updates the message window without clearing it, so that dot and the scroll position are kept. If
+// the window was edited, it is left alone.
+func updateMessage(win *acme.Win, nm notmuch.Backend, messageID string, allHeaders bool) error {
+	dirty, err := isDirty(win)
+	if err != nil || dirty {
+		return err
+	}
+
+	text, err := renderMessage(win, nm, messageID, allHeaders)
+	if err != nil {
+		return err
+	}
+
+	return replaceBody(win, text)
+}
+
+// displayMessage shows the message with the given ID. If it was opened from a query window, or from a thread window
+// that was, origin is the window's query. Moving past the end of the thread continues in the next threads listed
+// there.
+func displayMessage(wg *sync.WaitGroup, nm notmuch.Backend, messageID, origin string) {
 	// TODO:
 	// - "Attachments" command
 	//   - opens a new window with the attachments (MIME parts) listed, allows saving them somewhere
 	//   - Decode base64
-	// - Add "Headers" command to show full list of headers
 
 	defer wg.Done()
 
-	win, err := newWin("/Mail/message/"+messageID, "Next Reply [Tag +flagged] [|fmt -w 120]")
+	reg := _windows.open("message", messageID)
+	if reg == nil {
+		// Already open
+		return
+	}
+	defer _windows.close(reg)
+
+	win, err := newWin("/Mail/message/"+messageID, _config.Message.Tag)
 	if err != nil {
 		win.Errf("can't open message display window for %s: %s", messageID, err)
 		return
 	}
 
+	nm = warnTo(nm, win)
+
 	err = win.Fprintf("data", "Looking for message %s", messageID)
 	if err != nil {
 		win.Errf("can't write to body: %s", err)
 		return
 	}
 
-	err = refreshMessage(messageID, win)
+	err = refreshMessage(nm, messageID, win)
 	if err != nil {
 		win.Errf("can't refresh message: %s", err)
 		return
 	}
 
-	if _removeUnreadTag {
-		err = tagMessage("-unread", messageID)
+	// Let the thread window know that the message is shown, and again once the window is closed
+	threadID, err := threadOf(nm, messageID)
+	if err == nil {
+		_bus.publish(messageWindowEvent{MessageID: messageID, ThreadID: threadID})
+
+		defer func() {
+			_windows.close(reg)
+			_bus.publish(messageWindowEvent{MessageID: messageID, ThreadID: threadID})
+		}()
+	}
+
+	if _config.Message.RemoveUnread {
+		err = tagMessage(nm, "-unread", messageID)
 		if err != nil {
 			win.Errf("can't remove 'unread' tag from message %s", messageID)
 			return
 		}
 	}
 
-	for evt := range win.EventChan() {
+	// allHeaders is toggled by the Headers command
+	allHeaders := false
+
+	sub := _bus.subscribe()
+	defer _bus.cancel(sub)
+
+	events := win.EventChan()
+
+	for {
+		var evt *acme.Event
+
+		select {
+		case e := <-sub.C:
+			switch e := e.(type) {
+			case tagEvent:
+				if !e.hasMessage(messageID) {
+					continue
+				}
+			case dbChanged:
+			default:
+				continue
+			}
+
+			err := updateMessage(win, nm, messageID, allHeaders)
+			if err != nil {
+				win.Errf("can't update message: %s", err)
+			}
+
+			continue
+		case <-reg.Raise:
+			err := win.Ctl("show")
+			if err == nil {
+				err = updateMessage(win, nm, messageID, allHeaders)
+			}
+
+			if err != nil {
+				win.Errf("can't update message: %s", err)
+			}
+
+			continue
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+
+			evt = ev
+		}
+
 		// Only listen to l and L events to catch right click on a thread ID
 		// x and X go right back to acme
 		switch evt.C2 {
@@ -276,34 +614,130 @@ func displayMessage(wg *sync.WaitGroup, messageID string) {
 			cmd, arg := getCommandArgs(evt)
 
 			switch cmd {
-			case "Next":
-				err := nextUnread(wg, win, messageID)
+			case "Next", "Prev", "NextAny", "PrevAny":
+				step := messageSteps[cmd]
+
+				err := openNext(wg, nm, messageID, origin, step.forward, step.unread)
 				if err != nil {
-					win.Errf("can't jump to next unread message: %s", err)
+					win.Errf("can't open %s message: %s", strings.ToLower(strings.TrimSuffix(cmd, "Any")), err)
+				}
+				continue
+			case "Parent", "FirstChild", "NextSibling", "PrevSibling":
+				err := openRelated(wg, nm, messageID, origin, treeNeighbours[cmd])
+				if err != nil {
+					win.Errf("can't open %s: %s", cmd, err)
 				}
 				continue
 			case "Reply":
-				err := composeReply(wg, win, messageID)
+				err := composeReply(wg, nm, win, messageID)
 				if err != nil {
 					win.Errf("can't compose reply: %s", err)
 				}
 				continue
 			case "Tag":
-				err := tagMessage(arg, messageID)
+				err := tagMessage(nm, arg, messageID)
 				if err != nil {
 					win.Errf("can't update tags: %s", err)
 				}
 
-				err = refreshMessage(messageID, win)
+				continue
+			case "Spam", "Ham":
+				err := markSpam(nm, []string{"id:" + messageID}, cmd == "Spam")
+				if err != nil {
+					win.Errf("can't mark message as %s: %s", strings.ToLower(cmd), err)
+				}
+
+				continue
+			case "Thread":
+				threadID, err := threadOf(nm, messageID)
+				if err != nil {
+					win.Errf("can't find thread of message %s: %s", messageID, err)
+					continue
+				}
+
+				wg.Add(1)
+				go displayThread(wg, nm, threadID, origin, messageID)
+
+				continue
+			case "Headers":
+				// updateMessage leaves edited windows alone, so only switch if the window will be re-rendered
+				dirty, err := isDirty(win)
+				if err == nil && dirty {
+					win.Errf("message window was edited, not switching headers")
+					continue
+				}
+
+				if err == nil {
+					err = updateMessage(win, nm, messageID, !allHeaders)
+				}
+
+				if err != nil {
+					win.Errf("can't update message: %s", err)
+					continue
+				}
+
+				allHeaders = !allHeaders
+
+				continue
+			case "Raw":
+				wg.Add(1)
+				go displayRaw(wg, nm, messageID)
+
+				continue
+			case "Conversation":
+				threadID, err := threadOf(nm, messageID)
+				if err != nil {
+					win.Errf("can't find thread of message %s: %s", messageID, err)
+					continue
+				}
+
+				wg.Add(1)
+				go displayConversation(wg, nm, threadID)
+
+				continue
+			case "Mute", "Unmute":
+				threadID, err := threadOf(nm, messageID)
+				if err == nil {
+					err = muteThread(nm, threadID, cmd == "Mute")
+				}
+
+				if err != nil {
+					win.Errf("can't %s thread: %s", strings.ToLower(cmd), err)
+				}
+
+				continue
+			case "Delete", "Archive":
+				action := _config.Delete
+				if cmd == "Archive" {
+					action = _config.Archive
+				}
+
+				err := tagEach(nm, action.Tags, []string{"id:" + messageID})
 				if err != nil {
-					win.Errf("can't refresh message: %s", err)
+					win.Errf("can't change tags of message %s: %s", messageID, err)
+					continue
+				}
+
+				switch action.After {
+				case "next":
+					err := openNext(wg, nm, messageID, origin, true, true)
+					if err != nil {
+						win.Errf("can't jump to next unread message: %s", err)
+					}
+
+					win.Del(true)
+
+					return
+				case "close":
+					win.Del(true)
+
 					return
 				}
 
 				continue
 			}
 
-			err := handleCommand(wg, win, evt)
+			err := handleCommand(wg, nm, win, evt)
 			switch err {
 			case nil:
 				// Nothing to do, event already handled
@@ -319,6 +753,11 @@ func displayMessage(wg *sync.WaitGroup, messageID string) {
 
 			continue
 		case 'l', 'L':
+			// Short message IDs, e.g. copied from a thread window
+			if look(wg, nm, string(evt.Text), origin) == nil {
+				continue
+			}
+
 			err := win.WriteEvent(evt)
 			if err != nil {
 				win.Errf("can't write event: %s", err)
@@ -330,3 +769,98 @@ func displayMessage(wg *sync.WaitGroup, messageID string) {
 		}
 	}
 }
+
+// displayRaw shows the unmodified source of the message with the given ID
+func displayRaw(wg *sync.WaitGroup, nm notmuch.Backend, messageID string) {
+	defer wg.Done()
+
+	reg := _windows.open("raw", messageID)
+	if reg == nil {
+		// Already open
+		return
+	}
+	defer _windows.close(reg)
+
+	win, err := newWin("/Mail/message/"+messageID+"/raw", "Get")
+	if err != nil {
+		log.Printf("can't open raw message window for %s: %s", messageID, err)
+		return
+	}
+
+	nm = warnTo(nm, win)
+
+	refresh := func() error {
+		raw, err := nm.ShowRaw(messageID)
+		if err != nil {
+			return err
+		}
+
+		win.Clear()
+
+		_, err = win.Write("body", raw)
+		if err != nil {
+			return err
+		}
+
+		return winClean(win)
+	}
+
+	err = refresh()
+	if err != nil {
+		win.Errf("can't show raw message %s: %s", messageID, err)
+		return
+	}
+
+	events := win.EventChan()
+
+	for {
+		var evt *acme.Event
+
+		select {
+		case <-reg.Raise:
+			err := win.Ctl("show")
+			if err != nil {
+				win.Errf("can't show window: %s", err)
+			}
+
+			continue
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+
+			evt = ev
+		}
+
+		switch evt.C2 {
+		case 'x', 'X':
+			if string(evt.Text) == "Get" {
+				err := refresh()
+				if err != nil {
+					win.Errf("can't show raw message %s: %s", messageID, err)
+				}
+
+				continue
+			}
+
+			err := handleCommand(wg, nm, win, evt)
+			switch err {
+			case nil:
+				// Nothing to do, event already handled
+			case errNotACommand:
+				// Let ACME handle the event
+				err := win.WriteEvent(evt)
+				if err != nil {
+					return
+				}
+			default:
+				win.Errf("can't handle event: %s", err)
+			}
+		case 'l', 'L':
+			err := win.WriteEvent(evt)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
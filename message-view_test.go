@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHeaderFields(t *testing.T) {
+	raw := "Received: from mx.example.com\r\n" +
+		"\tby mail.example.com; Mon, 20 Jul 2020 13:00:00 +0000\r\n" +
+		"Received: from localhost by mx.example.com\r\n" +
+		"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n" +
+		"From: Alice <alice@example.com>\r\n" +
+		"\r\n" +
+		"Not: a header\r\n"
+
+	assert.Equal(t, []headerField{
+		{Name: "Received", Value: "from mx.example.com by mail.example.com; Mon, 20 Jul 2020 13:00:00 +0000"},
+		{Name: "Received", Value: "from localhost by mx.example.com"},
+		{Name: "Subject", Value: "Grüße"},
+		{Name: "From", Value: "Alice <alice@example.com>"},
+	}, parseHeaderFields([]byte(raw)))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/farhaven/acme-notmuch/notmuch"
+)
+
+// threadOf returns the ID of the thread that the message with the given ID belongs to
+func threadOf(nm notmuch.Backend, messageID string) (string, error) {
+	var threadIDs []string
+
+	err := decodeSearch(nm, "id:"+messageID, notmuch.SearchOptions{Output: "threads"}, &threadIDs)
+	if err != nil {
+		return "", err
+	}
+
+	if len(threadIDs) == 0 {
+		return "", errors.New("can't find thread for message")
+	} else if len(threadIDs) > 1 {
+		return "", errors.New("more than one thread id for message")
+	}
+
+	return threadIDs[0], nil
+}
+
+// muteThread tags the thread with the given ID as muted and marks it read. If mute is false, the thread is unmuted
+// instead.
+func muteThread(nm notmuch.Backend, threadID string, mute bool) error {
+	tags := []string{"-" + _config.Mute.Tag}
+	if mute {
+		tags = []string{"+" + _config.Mute.Tag, "-unread"}
+	}
+
+	return tagEach(nm, tags, []string{"thread:" + threadID})
+}
+
+// stripMuted applies the tag changes for muted threads to the messages of muted threads that still need them, e.g.
+// new messages that arrived since the thread was muted
+func stripMuted(nm notmuch.Backend) error {
+	// Only look at messages whose tags would change
+	var pending []string
+	for _, t := range _config.Mute.Strip {
+		if t[0] == '+' {
+			pending = append(pending, "not tag:"+t[1:])
+		} else {
+			pending = append(pending, "tag:"+t[1:])
+		}
+	}
+
+	needed := "(" + strings.Join(pending, " or ") + ")"
+
+	// Intersect the threads with such messages with the muted ones, so that the queries don't grow with the number
+	// of muted threads
+	var candidates []string
+
+	err := decodeSearch(nm, needed, notmuch.SearchOptions{Output: "threads"}, &candidates)
+	if err != nil || len(candidates) == 0 {
+		return err
+	}
+
+	var mutedIDs []string
+
+	err = decodeSearch(nm, "tag:"+_config.Mute.Tag, notmuch.SearchOptions{Output: "threads"}, &mutedIDs)
+	if err != nil {
+		return err
+	}
+
+	muted := make(map[string]bool)
+	for _, id := range mutedIDs {
+		muted[id] = true
+	}
+
+	var queries []string
+	for _, id := range candidates {
+		if muted[id] {
+			queries = append(queries, "thread:"+id+" and "+needed)
+		}
+	}
+
+	if len(queries) == 0 {
+		return nil
+	}
+
+	// These changes happen on every refresh, undoing them would only hide the user's own changes
+	return tagEachUnrecorded(nm, _config.Mute.Strip, queries)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMute(t *testing.T) {
+	fake, restore := setupTagTest(t)
+	defer restore()
+
+	count := func(query string) int { return countMessages(t, fake, query) }
+
+	require.NoError(t, muteThread(fake, "0000000000000001", true))
+	assert.Equal(t, 4, count("tag:muted"))
+	assert.Equal(t, 0, count("thread:0000000000000001 and tag:unread"))
+	assert.Equal(t, 4, count("thread:0000000000000001 and tag:inbox"))
+
+	// A new message arrives in the thread
+	require.NoError(t, fake.Tag([]string{"+unread"}, "id:reply3@example.com"))
+
+	undoable := _journal.undoable(1)
+
+	require.NoError(t, stripMuted(fake))
+	assert.Equal(t, 0, count("thread:0000000000000001 and (tag:unread or tag:inbox)"))
+	assert.Equal(t, 1, count("tag:unread"))
+
+	// Stripping isn't recorded, Undo still reverts muting the thread
+	assert.Equal(t, undoable, _journal.undoable(1))
+
+	require.NoError(t, muteThread(fake, "0000000000000001", false))
+	assert.Equal(t, 0, count("tag:muted"))
+}
@@ -0,0 +1,422 @@
+package notmuch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CLI is a Backend that runs the notmuch command. Output on stdout and stderr is kept separate, so that warnings
+// don't end up in the JSON that is to be decoded.
+type CLI struct {
+	// Path to the notmuch binary. If empty, "notmuch" is looked up in $PATH
+	Path string
+
+	// Warn is called with every line notmuch writes to stderr when it otherwise succeeds. May be nil.
+	Warn func(string)
+}
+
+// WithWarnings returns a Backend that passes warnings from notmuch to warn. Backends that don't produce warnings
+// are returned unchanged.
+func WithWarnings(b Backend, warn func(string)) Backend {
+	c, ok := b.(*CLI)
+	if !ok {
+		return b
+	}
+
+	dup := *c
+	dup.Warn = warn
+
+	return &dup
+}
+
+func (c *CLI) command(args ...string) *exec.Cmd {
+	path := c.Path
+	if path == "" {
+		path = "notmuch"
+	}
+
+	return exec.Command(path, args...)
+}
+
+// warn passes each line of stderr to c.Warn
+func (c *CLI) warn(stderr []byte) {
+	if c.Warn == nil {
+		return
+	}
+
+	for _, line := range strings.Split(string(stderr), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			c.Warn(line)
+		}
+	}
+}
+
+func (c *CLI) run(args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := c.command(args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, classify(args[0], stderr.String(), err)
+	}
+
+	c.warn(stderr.Bytes())
+
+	return stdout.Bytes(), nil
+}
+
+// cmdReader reads the output of a running notmuch command
+type cmdReader struct {
+	io.ReadCloser
+	cli     *CLI
+	cmd     *exec.Cmd
+	command string
+	stderr  bytes.Buffer
+	eof     bool
+}
+
+func (r *cmdReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+
+	return n, err
+}
+
+// Close waits for notmuch to exit. If the caller stopped reading before the end of the output, notmuch is stopped
+// instead of producing the rest of it.
+func (r *cmdReader) Close() error {
+	// Decoders usually leave the trailing newline unread
+	rest, _ := ioutil.ReadAll(io.LimitReader(r, 64))
+	if !r.eof && len(bytes.TrimSpace(rest)) != 0 {
+		r.cmd.Process.Kill()
+		r.cmd.Wait()
+
+		return nil
+	}
+
+	io.Copy(ioutil.Discard, r)
+
+	err := r.cmd.Wait()
+	if err != nil {
+		return classify(r.command, r.stderr.String(), err)
+	}
+
+	r.cli.warn(r.stderr.Bytes())
+
+	return nil
+}
+
+// stream starts notmuch with the given arguments and returns a reader for its output
+func (c *CLI) stream(args ...string) (io.ReadCloser, error) {
+	r := &cmdReader{
+		cli:     c,
+		cmd:     c.command(args...),
+		command: args[0],
+	}
+
+	r.cmd.Stderr = &r.stderr
+
+	stdout, err := r.cmd.StdoutPipe()
+	if err != nil {
+		return nil, classify(args[0], "", err)
+	}
+
+	err = r.cmd.Start()
+	if err != nil {
+		return nil, classify(args[0], r.stderr.String(), err)
+	}
+
+	r.ReadCloser = stdout
+
+	return r, nil
+}
+
+func (c *CLI) Search(query string, opts SearchOptions) (io.ReadCloser, error) {
+	output := opts.Output
+	if output == "" {
+		output = "summary"
+	}
+
+	args := []string{"search", "--format=json", "--output=" + output}
+
+	if opts.Limit > 0 {
+		args = append(args, "--limit="+strconv.Itoa(opts.Limit))
+	}
+
+	if opts.Offset > 0 {
+		args = append(args, "--offset="+strconv.Itoa(opts.Offset))
+	}
+
+	if opts.Sort != "" {
+		args = append(args, "--sort="+opts.Sort)
+	}
+
+	if opts.IncludeExcluded {
+		args = append(args, "--exclude=false")
+	}
+
+	return c.stream(append(args, query)...)
+}
+
+func (c *CLI) Show(query string, opts ShowOptions) ([]byte, error) {
+	args := []string{
+		"show", "--format=json",
+		"--entire-thread=" + strconv.FormatBool(opts.EntireThread),
+		"--body=" + strconv.FormatBool(opts.Body),
+	}
+
+	if opts.IncludeHTML {
+		args = append(args, "--include-html")
+	}
+
+	if opts.Decrypt {
+		args = append(args, "--decrypt=true")
+	}
+
+	if opts.IncludeExcluded {
+		args = append(args, "--exclude=false")
+	}
+
+	return c.run(append(args, query)...)
+}
+
+func (c *CLI) ShowRaw(messageID string) ([]byte, error) {
+	return c.run("show", "--format=raw", "id:"+messageID)
+}
+
+func (c *CLI) Tag(tags []string, query string) error {
+	args := []string{"tag"}
+	args = append(args, tags...)
+	args = append(args, "--", query)
+
+	_, err := c.run(args...)
+	return err
+}
+
+// encodeBatchTag hex-encodes s for use as a tag in the input of `notmuch tag --batch`
+func encodeBatchTag(s string) string {
+	var res strings.Builder
+
+	for _, b := range []byte(s) {
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || strings.IndexByte("@=.,_+-", b) != -1 {
+			res.WriteByte(b)
+		} else {
+			fmt.Fprintf(&res, "%%%02x", b)
+		}
+	}
+
+	return res.String()
+}
+
+// batchLine renders op as a line for `notmuch tag --batch`. Search terms are separated by spaces and passed on as
+// they are, except for literal percent signs, which would otherwise start a hex escape.
+func batchLine(op TagOp) string {
+	var fields []string
+
+	for _, t := range op.Tags {
+		fields = append(fields, t[:1]+encodeBatchTag(t[1:]))
+	}
+
+	fields = append(fields, "--")
+
+	for _, term := range strings.Fields(op.Query) {
+		fields = append(fields, strings.ReplaceAll(term, "%", "%25"))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+func (c *CLI) TagBatch(ops []TagOp) error {
+	var (
+		failures []BatchFailure
+		runErr   error
+		input    bytes.Buffer
+		lines    = make(map[string][]int) // Maps lines to indices in ops, identical ops share a line
+	)
+
+	for idx, op := range ops {
+		err := checkTagOp(op)
+		if err != nil {
+			failures = append(failures, BatchFailure{Index: idx, Op: op, Message: err.Error()})
+			continue
+		}
+
+		line := batchLine(op)
+		lines[line] = append(lines[line], idx)
+
+		input.WriteString(line + "\n")
+	}
+
+	if input.Len() != 0 {
+		var stderr bytes.Buffer
+
+		cmd := c.command("tag", "--batch")
+		cmd.Stdin = &input
+		cmd.Stderr = &stderr
+
+		runErr = cmd.Run()
+
+		// notmuch reports lines it can't process, and the line itself, on stderr. Everything else is either a
+		// warning or, if notmuch failed, the reason for the failure.
+		var other []string
+
+		reported := make(map[string]bool)
+
+		for _, msg := range strings.Split(stderr.String(), "\n") {
+			msg = strings.TrimSpace(msg)
+			if msg == "" {
+				continue
+			}
+
+			found := false
+			for line, indices := range lines {
+				if !strings.Contains(msg, line) {
+					continue
+				}
+
+				found = true
+
+				// Every op with this line failed, but notmuch may report the line once for each of them
+				if !reported[line] {
+					reported[line] = true
+
+					for _, idx := range indices {
+						failures = append(failures, BatchFailure{Index: idx, Op: ops[idx], Message: msg})
+					}
+				}
+
+				break
+			}
+
+			if !found {
+				other = append(other, msg)
+			}
+		}
+
+		if runErr != nil {
+			runErr = classify("tag", strings.Join(other, "\n"), runErr)
+		} else {
+			c.warn([]byte(strings.Join(other, "\n")))
+		}
+	}
+
+	if len(failures) != 0 {
+		sort.Slice(failures, func(i, j int) bool {
+			return failures[i].Index < failures[j].Index
+		})
+
+		return &BatchError{Failures: failures, Err: runErr}
+	}
+
+	return runErr
+}
+
+func (c *CLI) Reply(messageID string) ([]byte, error) {
+	return c.run("reply", "id:"+messageID)
+}
+
+func (c *CLI) Count(query string, opts CountOptions) (int, error) {
+	args := []string{"count"}
+
+	if opts.IncludeExcluded {
+		args = append(args, "--exclude=false")
+	}
+
+	output, err := c.run(append(args, query)...)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(string(bytes.TrimSpace(output)))
+}
+
+func (c *CLI) Revision() (string, error) {
+	output, err := c.run("count", "--lastmod")
+	if err != nil {
+		return "", err
+	}
+
+	// Output is the number of messages, the database UUID and the last modification
+	fields := strings.Fields(string(output))
+	if len(fields) != 3 {
+		return "", fmt.Errorf("unexpected output from notmuch count --lastmod: %q", output)
+	}
+
+	return fields[1] + " " + fields[2], nil
+}
+
+func (c *CLI) Insert(folder string, tags []string, msg []byte) error {
+	args := []string{"insert", "--create-folder", "--folder=" + folder}
+	args = append(args, tags...)
+
+	var stderr bytes.Buffer
+
+	cmd := c.command(args...)
+	cmd.Stdin = bytes.NewReader(msg)
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return classify("insert", stderr.String(), err)
+	}
+
+	c.warn(stderr.Bytes())
+
+	return nil
+}
+
+func (c *CLI) ConfigList() (map[string]string, error) {
+	output, err := c.run("config", "list")
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string)
+
+	for _, line := range strings.Split(string(output), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		res[parts[0]] = parts[1]
+	}
+
+	return res, nil
+}
+
+func (c *CLI) Address(query string) ([]string, error) {
+	output, err := c.run("address", "--format=json", "--output=sender", query)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []struct {
+		NameAddr string `json:"name-addr"`
+	}
+
+	err = json.Unmarshal(output, &addrs)
+	if err != nil {
+		return nil, fmt.Errorf("decoding addresses: %w", err)
+	}
+
+	var res []string
+	for _, a := range addrs {
+		res = append(res, a.NameAddr)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,150 @@
+package notmuch
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNotmuch returns a CLI that runs the given shell script instead of notmuch, and a function that removes the
+// script again
+func fakeNotmuch(t *testing.T, script string) (*CLI, func()) {
+	dir, err := ioutil.TempDir("", "acme-notmuch")
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "notmuch")
+	require.NoError(t, ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755))
+
+	return &CLI{Path: path}, func() { os.RemoveAll(dir) }
+}
+
+func TestCLI_Warnings(t *testing.T) {
+	c, cleanup := fakeNotmuch(t, `echo 'Warning: ignoring unknown config key' >&2; echo '["0000000000000001"]'`)
+	defer cleanup()
+
+	var warnings []string
+	nm := WithWarnings(c, func(w string) { warnings = append(warnings, w) })
+
+	r, err := nm.Search("*", SearchOptions{Output: "threads"})
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	assert.Equal(t, "[\"0000000000000001\"]\n", string(data))
+	assert.Equal(t, []string{"Warning: ignoring unknown config key"}, warnings)
+}
+
+func TestCLI_TagBatch(t *testing.T) {
+	c, cleanup := fakeNotmuch(t, `
+cat > "$(dirname "$0")/input"
+grep 'bad' "$(dirname "$0")/input" | sed 's/^/Warning: illegal tag (skipping): /' >&2
+exit 0
+`)
+	defer cleanup()
+
+	err := c.TagBatch([]TagOp{
+		{Tags: []string{"+foo", "-bar baz"}, Query: "id:a@example.com"},
+		{Tags: []string{"+bad"}, Query: "thread:0000000000000001"},
+		{Tags: []string{"nope"}, Query: "id:b@example.com"},
+		{Tags: []string{"+100%"}, Query: "id:c%d@example.com"},
+	})
+
+	var batchErr *BatchError
+	require.True(t, errors.As(err, &batchErr), "%v", err)
+	require.Len(t, batchErr.Failures, 2)
+	assert.Equal(t, 1, batchErr.Failures[0].Index)
+	assert.Equal(t, "Warning: illegal tag (skipping): +bad -- thread:0000000000000001", batchErr.Failures[0].Message)
+	assert.Equal(t, 2, batchErr.Failures[1].Index)
+
+	input, err := ioutil.ReadFile(filepath.Join(filepath.Dir(c.Path), "input"))
+	require.NoError(t, err)
+	assert.Equal(t, "+foo -bar%20baz -- id:a@example.com\n+bad -- thread:0000000000000001\n+100%25 -- id:c%25d@example.com\n", string(input))
+}
+
+func TestCLI_Revision(t *testing.T) {
+	c, cleanup := fakeNotmuch(t, `[ "$*" = "count --lastmod" ] && printf '42\t6a3bb0cf-f6d4-4d0b-9b7d-0e8e1f1b4f2c\t1337\n'`)
+	defer cleanup()
+
+	rev, err := c.Revision()
+	require.NoError(t, err)
+	assert.Equal(t, "6a3bb0cf-f6d4-4d0b-9b7d-0e8e1f1b4f2c 1337", rev)
+}
+
+func TestCLI_TagBatchFailing(t *testing.T) {
+	c, cleanup := fakeNotmuch(t, `
+cat > /dev/null
+echo 'Warning: illegal tag (skipping): +bad -- id:a@example.com' >&2
+echo 'A Xapian exception occurred: Unable to get write lock' >&2
+exit 1
+`)
+	defer cleanup()
+
+	err := c.TagBatch([]TagOp{
+		{Tags: []string{"+bad"}, Query: "id:a@example.com"},
+		{Tags: []string{"nope"}, Query: "id:b@example.com"},
+		{Tags: []string{"+good"}, Query: "id:c@example.com"},
+	})
+
+	var batchErr *BatchError
+	require.True(t, errors.As(err, &batchErr), "%v", err)
+	require.Len(t, batchErr.Failures, 2)
+	assert.Equal(t, 0, batchErr.Failures[0].Index)
+	assert.Equal(t, 1, batchErr.Failures[1].Index)
+	assert.True(t, errors.Is(err, &Error{Kind: ErrDatabaseLocked}), "%v", err)
+}
+
+func TestCLI_SearchStopped(t *testing.T) {
+	c, cleanup := fakeNotmuch(t, `echo '['; while :; do echo '"0000000000000001",'; done`)
+	defer cleanup()
+
+	r, err := c.Search("*", SearchOptions{Output: "threads"})
+	require.NoError(t, err)
+
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(r, buf)
+	require.NoError(t, err)
+
+	// notmuch never finishes on its own
+	assert.NoError(t, r.Close())
+}
+
+func TestCLI_CountExcluded(t *testing.T) {
+	c, cleanup := fakeNotmuch(t, `[ "$*" = "count --exclude=false tag:spam" ] && echo 3 || echo 1`)
+	defer cleanup()
+
+	n, err := c.Count("tag:spam", CountOptions{IncludeExcluded: true})
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	n, err = c.Count("tag:spam", CountOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestCLI_TagBatchDuplicates(t *testing.T) {
+	c, cleanup := fakeNotmuch(t, `
+cat > /dev/null
+echo 'Warning: illegal tag (skipping): +bad -- id:a@example.com' >&2
+`)
+	defer cleanup()
+
+	err := c.TagBatch([]TagOp{
+		{Tags: []string{"+bad"}, Query: "id:a@example.com"},
+		{Tags: []string{"+good"}, Query: "id:a@example.com"},
+		{Tags: []string{"+bad"}, Query: "id:a@example.com"},
+	})
+
+	var batchErr *BatchError
+	require.True(t, errors.As(err, &batchErr), "%v", err)
+	require.Len(t, batchErr.Failures, 2)
+	assert.Equal(t, 0, batchErr.Failures[0].Index)
+	assert.Equal(t, 2, batchErr.Failures[1].Index)
+}
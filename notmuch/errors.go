@@ -0,0 +1,115 @@
+package notmuch
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ErrorKind classifies failures of the notmuch command
+type ErrorKind int
+
+const (
+	// ErrUnknown is any failure that doesn't fit one of the other kinds
+	ErrUnknown ErrorKind = iota
+	// ErrQuerySyntax means that the query could not be parsed
+	ErrQuerySyntax
+	// ErrDatabaseLocked means that another process holds the write lock on the database
+	ErrDatabaseLocked
+	// ErrDatabaseMissing means that there is no database at the configured location
+	ErrDatabaseMissing
+	// ErrBinaryMissing means that the notmuch command could not be found
+	ErrBinaryMissing
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrQuerySyntax:
+		return "query syntax error"
+	case ErrDatabaseLocked:
+		return "database locked"
+	case ErrDatabaseMissing:
+		return "database missing"
+	case ErrBinaryMissing:
+		return "notmuch binary missing"
+	default:
+		return "notmuch failed"
+	}
+}
+
+// Error is returned by CLI if running notmuch fails
+type Error struct {
+	Kind    ErrorKind
+	Command string // The notmuch subcommand, e.g. "search"
+	Stderr  string // Whatever notmuch wrote to stderr
+	Err     error  // The underlying error, usually an *exec.ExitError
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("notmuch %s: %s", e.Command, e.Kind)
+
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	} else if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, &Error{Kind: k}) match any *Error of kind k
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+
+	return t.Kind == e.Kind && t.Command == "" && t.Err == nil
+}
+
+// stderrPatterns maps fragments of notmuch's (and Xapian's) error messages to error kinds. Matching is
+// case-insensitive and the first match wins.
+var stderrPatterns = []struct {
+	fragment string
+	kind     ErrorKind
+}{
+	{"parsing query", ErrQuerySyntax},
+	{"syntax error", ErrQuerySyntax},
+	{"unable to get write lock", ErrDatabaseLocked},
+	{"database is locked", ErrDatabaseLocked},
+	{"could not open database", ErrDatabaseMissing},
+	{"cannot open database", ErrDatabaseMissing},
+	{"error opening database", ErrDatabaseMissing},
+	{"database not found", ErrDatabaseMissing},
+	{"no database found", ErrDatabaseMissing},
+}
+
+// classify builds an *Error for a failed run of the notmuch subcommand command
+func classify(command string, stderr string, err error) *Error {
+	e := &Error{
+		Kind:    ErrUnknown,
+		Command: command,
+		Stderr:  strings.TrimSpace(stderr),
+		Err:     err,
+	}
+
+	if errors.Is(err, exec.ErrNotFound) {
+		e.Kind = ErrBinaryMissing
+		return e
+	}
+
+	lower := strings.ToLower(stderr)
+	for _, p := range stderrPatterns {
+		if strings.Contains(lower, p.fragment) {
+			e.Kind = p.kind
+			break
+		}
+	}
+
+	return e
+}
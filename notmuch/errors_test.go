@@ -0,0 +1,29 @@
+package notmuch
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		stderr string
+		err    error
+		kind   ErrorKind
+	}{
+		{"A Xapian exception occurred parsing query: Syntax: <expression> AND <expression>\n", nil, ErrQuerySyntax},
+		{"A Xapian exception occurred opening database: Unable to get write lock on /home/u/mail/.notmuch/xapian: already locked\n", nil, ErrDatabaseLocked},
+		{"Error: Cannot open database at /home/u/mail/.notmuch: No such file or directory.\n", nil, ErrDatabaseMissing},
+		{"", &exec.Error{Name: "notmuch", Err: exec.ErrNotFound}, ErrBinaryMissing},
+		{"Something else entirely\n", nil, ErrUnknown},
+	}
+
+	for _, tc := range tests {
+		e := classify("search", tc.stderr, tc.err)
+		assert.Equal(t, tc.kind, e.Kind, "stderr %q", tc.stderr)
+		assert.True(t, errors.Is(e, &Error{Kind: tc.kind}))
+	}
+}
@@ -0,0 +1,1020 @@
+package notmuch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type fakeMessage struct {
+	id        string
+	thread    string
+	timestamp int64
+	headers   map[string]string
+	tags      map[string]bool
+	fields    map[string]json.RawMessage // The message as it appeared in the fixture
+}
+
+func (m *fakeMessage) sortedTags() []string {
+	tags := make([]string, 0, len(m.tags))
+	for t := range m.tags {
+		tags = append(tags, t)
+	}
+
+	sort.Strings(tags)
+
+	return tags
+}
+
+func (m *fakeMessage) applyTagOps(tags []string) {
+	for _, t := range tags {
+		if t[0] == '+' {
+			m.tags[t[1:]] = true
+		} else {
+			delete(m.tags, t[1:])
+		}
+	}
+}
+
+type fakeNode struct {
+	msg     *fakeMessage
+	replies []*fakeNode
+}
+
+type fakeThread struct {
+	id    string
+	nodes []*fakeNode
+}
+
+// messages returns the messages in t in pre-order
+func (t *fakeThread) messages() []*fakeMessage {
+	var res []*fakeMessage
+
+	var walk func([]*fakeNode)
+	walk = func(nodes []*fakeNode) {
+		for _, n := range nodes {
+			res = append(res, n.msg)
+			walk(n.replies)
+		}
+	}
+
+	walk(t.nodes)
+
+	return res
+}
+
+// Fake is an in-memory Backend. It is meant for tests and supports a subset of the notmuch query language:
+// the terms "*", "id:", "thread:", "tag:", "from:", "subject:" and bare words, combined with "and", "or",
+// "not" and parentheses. Messages with tags from the search.exclude_tags configuration item are excluded like
+// notmuch excludes them, unless the query mentions the tag.
+type Fake struct {
+	mu       sync.Mutex
+	threads  []*fakeThread
+	messages map[string]*fakeMessage
+	config   map[string]string
+	revision int // Incremented on every change
+}
+
+// LoadFake creates a Fake from threads in the format of `notmuch show --format=json`. Thread IDs are assigned in
+// the order in which the threads appear in the input, starting at 0000000000000001.
+func LoadFake(r io.Reader) (*Fake, error) {
+	var rawThreads []json.RawMessage
+
+	err := json.NewDecoder(r).Decode(&rawThreads)
+	if err != nil {
+		return nil, fmt.Errorf("decoding threads: %w", err)
+	}
+
+	f := &Fake{
+		messages: make(map[string]*fakeMessage),
+		config:   make(map[string]string),
+	}
+
+	for idx, rawThread := range rawThreads {
+		thread := &fakeThread{
+			id: fmt.Sprintf("%016x", idx+1),
+		}
+
+		thread.nodes, err = f.loadNodes(thread.id, rawThread)
+		if err != nil {
+			return nil, fmt.Errorf("loading thread %d: %w", idx, err)
+		}
+
+		f.threads = append(f.threads, thread)
+	}
+
+	return f, nil
+}
+
+// loadNodes decodes a list of [message, [replies]] pairs. Replies to missing (null) messages are attached to the
+// parent of the missing message.
+func (f *Fake) loadNodes(threadID string, data json.RawMessage) ([]*fakeNode, error) {
+	var pairs [][]json.RawMessage
+
+	err := json.Unmarshal(data, &pairs)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []*fakeNode
+
+	for _, pair := range pairs {
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("expected [message, replies], got %d elements", len(pair))
+		}
+
+		replies, err := f.loadNodes(threadID, pair[1])
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.Equal(bytes.TrimSpace(pair[0]), []byte("null")) {
+			nodes = append(nodes, replies...)
+			continue
+		}
+
+		msg, err := f.loadMessage(threadID, pair[0])
+		if err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, &fakeNode{msg: msg, replies: replies})
+	}
+
+	return nodes, nil
+}
+
+func (f *Fake) loadMessage(threadID string, data json.RawMessage) (*fakeMessage, error) {
+	var partial struct {
+		ID        string
+		Timestamp int64
+		Tags      []string
+		Headers   map[string]string
+	}
+
+	err := json.Unmarshal(data, &partial)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := f.messages[partial.ID]; ok {
+		return nil, fmt.Errorf("duplicate message %q", partial.ID)
+	}
+
+	msg := &fakeMessage{
+		id:        partial.ID,
+		thread:    threadID,
+		timestamp: partial.Timestamp,
+		headers:   partial.Headers,
+		tags:      make(map[string]bool),
+	}
+
+	err = json.Unmarshal(data, &msg.fields)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range partial.Tags {
+		msg.tags[t] = true
+	}
+
+	f.messages[msg.id] = msg
+
+	return msg, nil
+}
+
+// matching returns the threads that contain at least one message matching q, newest first, and the set of
+// matching messages
+func (f *Fake) matching(q fakeQuery) ([]*fakeThread, map[*fakeMessage]bool) {
+	var threads []*fakeThread
+	matched := make(map[*fakeMessage]bool)
+	newest := make(map[*fakeThread]int64)
+
+	for _, t := range f.threads {
+		found := false
+
+		for _, m := range t.messages() {
+			if !q.match(m) {
+				continue
+			}
+
+			found = true
+			matched[m] = true
+
+			if m.timestamp > newest[t] {
+				newest[t] = m.timestamp
+			}
+		}
+
+		if found {
+			threads = append(threads, t)
+		}
+	}
+
+	sort.SliceStable(threads, func(i, j int) bool {
+		return newest[threads[i]] > newest[threads[j]]
+	})
+
+	return threads, matched
+}
+
+// excludeTags returns the tags from the search.exclude_tags configuration item that q doesn't mention
+func (f *Fake) excludeTags(q fakeQuery) []string {
+	var tags []string
+
+	for _, t := range strings.Split(f.config["search.exclude_tags"], ";") {
+		t = strings.TrimSpace(t)
+		if t != "" && !mentionsTag(q, t) {
+			tags = append(tags, t)
+		}
+	}
+
+	return tags
+}
+
+// excluding returns q restricted to messages that don't have any of the excluded tags, unless include is set
+func (f *Fake) excluding(q fakeQuery, include bool) fakeQuery {
+	if include {
+		return q
+	}
+
+	var excluded fakeOr
+	for _, t := range f.excludeTags(q) {
+		excluded = append(excluded, fakeTerm{prefix: "tag", value: t})
+	}
+
+	if len(excluded) == 0 {
+		return q
+	}
+
+	return fakeAnd{q, fakeNot{excluded}}
+}
+
+// isExcluded returns whether m has one of the excluded tags of q
+func (f *Fake) isExcluded(q fakeQuery, m *fakeMessage) bool {
+	for _, t := range f.excludeTags(q) {
+		if m.tags[t] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// page returns the bounds of the part of a list of n results selected by opts
+func page(n int, opts SearchOptions) (int, int) {
+	lo := opts.Offset
+	if lo > n {
+		lo = n
+	}
+
+	hi := n
+	if opts.Limit > 0 && lo+opts.Limit < hi {
+		hi = lo + opts.Limit
+	}
+
+	return lo, hi
+}
+
+func (f *Fake) Search(query string, opts SearchOptions) (io.ReadCloser, error) {
+	output, err := f.search(query, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(output)), nil
+}
+
+func (f *Fake) search(query string, opts SearchOptions) ([]byte, error) {
+	q, err := parseFakeQuery("search", query)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	threads, matched := f.matching(f.excluding(q, opts.IncludeExcluded))
+
+	switch opts.Sort {
+	case "", "newest-first":
+	case "oldest-first":
+		for i, j := 0, len(threads)-1; i < j; i, j = i+1, j-1 {
+			threads[i], threads[j] = threads[j], threads[i]
+		}
+	default:
+		return nil, fmt.Errorf("unsupported sort order %q", opts.Sort)
+	}
+
+	switch opts.Output {
+	case "threads":
+		ids := []string{}
+		for _, t := range threads {
+			ids = append(ids, t.id)
+		}
+
+		lo, hi := page(len(ids), opts)
+
+		return json.Marshal(ids[lo:hi])
+	case "messages":
+		ids := []string{}
+		for _, t := range threads {
+			for _, m := range t.messages() {
+				if matched[m] {
+					ids = append(ids, m.id)
+				}
+			}
+		}
+
+		lo, hi := page(len(ids), opts)
+
+		return json.Marshal(ids[lo:hi])
+	case "", "summary":
+	default:
+		return nil, fmt.Errorf("unsupported output %q", opts.Output)
+	}
+
+	type summary struct {
+		Thread       string    `json:"thread"`
+		Timestamp    int64     `json:"timestamp"`
+		DateRelative string    `json:"date_relative"`
+		Matched      int       `json:"matched"`
+		Total        int       `json:"total"`
+		Authors      string    `json:"authors"`
+		Subject      string    `json:"subject"`
+		Query        []*string `json:"query"`
+		Tags         []string  `json:"tags"`
+	}
+
+	res := []summary{}
+
+	lo, hi := page(len(threads), opts)
+
+	for _, t := range threads[lo:hi] {
+		msgs := t.messages()
+
+		s := summary{
+			Thread:  t.id,
+			Total:   len(msgs),
+			Subject: msgs[0].headers["Subject"],
+		}
+
+		var (
+			authors []string
+			tags    = make(map[string]bool)
+		)
+
+		for _, m := range msgs {
+			for tag := range m.tags {
+				tags[tag] = true
+			}
+
+			if !matched[m] {
+				continue
+			}
+
+			s.Matched++
+			authors = append(authors, m.headers["From"])
+
+			if m.timestamp > s.Timestamp {
+				s.Timestamp = m.timestamp
+			}
+		}
+
+		for tag := range tags {
+			s.Tags = append(s.Tags, tag)
+		}
+		sort.Strings(s.Tags)
+
+		query := "thread:" + t.id
+		s.Authors = strings.Join(authors, ", ")
+		s.DateRelative = time.Unix(s.Timestamp, 0).UTC().Format("2006-01-02")
+		s.Query = []*string{&query, nil}
+
+		res = append(res, s)
+	}
+
+	return json.Marshal(res)
+}
+
+func (f *Fake) Show(query string, opts ShowOptions) ([]byte, error) {
+	q, err := parseFakeQuery("show", query)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	threads, matched := f.matching(f.excluding(q, opts.IncludeExcluded))
+
+	var renderNodes func([]*fakeNode) []interface{}
+	renderNodes = func(nodes []*fakeNode) []interface{} {
+		res := []interface{}{}
+
+		for _, n := range nodes {
+			var msg interface{}
+
+			if matched[n.msg] || opts.EntireThread {
+				fields := make(map[string]interface{})
+				for k, v := range n.msg.fields {
+					fields[k] = v
+				}
+
+				fields["tags"] = n.msg.sortedTags()
+				fields["match"] = matched[n.msg]
+				fields["excluded"] = f.isExcluded(q, n.msg)
+
+				if !opts.Body {
+					delete(fields, "body")
+				}
+
+				msg = fields
+			}
+
+			res = append(res, []interface{}{msg, renderNodes(n.replies)})
+		}
+
+		return res
+	}
+
+	res := []interface{}{}
+	for _, t := range threads {
+		res = append(res, renderNodes(t.nodes))
+	}
+
+	return json.Marshal(res)
+}
+
+// textContent returns the concatenated content of all text/plain parts in body
+func textContent(body json.RawMessage) string {
+	var parts []struct {
+		ContentType string `json:"content-type"`
+		Content     json.RawMessage
+	}
+
+	err := json.Unmarshal(body, &parts)
+	if err != nil {
+		return ""
+	}
+
+	var res []string
+
+	for _, p := range parts {
+		if p.ContentType == "text/plain" {
+			var s string
+			if json.Unmarshal(p.Content, &s) == nil {
+				res = append(res, s)
+			}
+
+			continue
+		}
+
+		if strings.HasPrefix(p.ContentType, "multipart/") {
+			txt := textContent(p.Content)
+			if txt != "" {
+				res = append(res, txt)
+			}
+		}
+	}
+
+	return strings.Join(res, "\n")
+}
+
+func (f *Fake) lookup(messageID string) (*fakeMessage, error) {
+	msg, ok := f.messages[messageID]
+	if !ok {
+		return nil, fmt.Errorf("no message with ID %q", messageID)
+	}
+
+	return msg, nil
+}
+
+func (f *Fake) ShowRaw(messageID string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	msg, err := f.lookup(messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	for _, hdr := range []string{"Date", "From", "To", "Cc", "Subject"} {
+		val, ok := msg.headers[hdr]
+		if !ok {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "%s: %s\n", hdr, val)
+	}
+
+	fmt.Fprintf(&buf, "Message-ID: <%s>\n\n%s\n", msg.id, textContent(msg.fields["body"]))
+
+	return buf.Bytes(), nil
+}
+
+func (f *Fake) Tag(tags []string, query string) error {
+	q, err := parseFakeQuery("tag", query)
+	if err != nil {
+		return err
+	}
+
+	err = CheckTagOps(tags)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, msg := range f.messages {
+		if q.match(msg) {
+			msg.applyTagOps(tags)
+		}
+	}
+
+	f.revision++
+
+	return nil
+}
+
+func (f *Fake) TagBatch(ops []TagOp) error {
+	var failures []BatchFailure
+
+	for idx, op := range ops {
+		err := checkTagOp(op)
+		if err == nil {
+			err = f.Tag(op.Tags, op.Query)
+		}
+
+		if err != nil {
+			failures = append(failures, BatchFailure{Index: idx, Op: op, Message: err.Error()})
+		}
+	}
+
+	if len(failures) != 0 {
+		return &BatchError{Failures: failures}
+	}
+
+	return nil
+}
+
+func (f *Fake) Reply(messageID string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	msg, err := f.lookup(messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := msg.headers["Subject"]
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "From: %s\nSubject: %s\nTo: %s\nIn-Reply-To: <%s>\nReferences: <%s>\n\n",
+		msg.headers["To"], subject, msg.headers["From"], msg.id, msg.id)
+	fmt.Fprintf(&buf, "On %s, %s wrote:\n", msg.headers["Date"], msg.headers["From"])
+
+	for _, line := range strings.Split(textContent(msg.fields["body"]), "\n") {
+		fmt.Fprintf(&buf, "> %s\n", line)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (f *Fake) Count(query string, opts CountOptions) (int, error) {
+	q, err := parseFakeQuery("count", query)
+	if err != nil {
+		return 0, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	q = f.excluding(q, opts.IncludeExcluded)
+
+	count := 0
+	for _, msg := range f.messages {
+		if q.match(msg) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (f *Fake) Address(query string) ([]string, error) {
+	q, err := parseFakeQuery("address", query)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var (
+		res  []string
+		seen = make(map[string]bool)
+	)
+
+	threads, matched := f.matching(f.excluding(q, false))
+	for _, t := range threads {
+		for _, m := range t.messages() {
+			from := m.headers["From"]
+			if !matched[m] || seen[from] {
+				continue
+			}
+
+			seen[from] = true
+			res = append(res, from)
+		}
+	}
+
+	return res, nil
+}
+
+// Insert adds msg as a new thread. The folder is ignored.
+func (f *Fake) Insert(folder string, tags []string, msg []byte) error {
+	// Validate before loading the message, so that a rejected message doesn't stay in the index
+	err := CheckTagOps(tags)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return fmt.Errorf("parsing message: %w", err)
+	}
+
+	body, err := ioutil.ReadAll(parsed.Body)
+	if err != nil {
+		return fmt.Errorf("reading message body: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	thread := &fakeThread{
+		id: fmt.Sprintf("%016x", len(f.threads)+1),
+	}
+
+	id := strings.Trim(parsed.Header.Get("Message-ID"), "<>")
+	if id == "" {
+		id = fmt.Sprintf("inserted-%s@fake", thread.id)
+	}
+
+	headers := make(map[string]string)
+	for _, hdr := range []string{"Date", "From", "To", "Cc", "Subject"} {
+		if val := parsed.Header.Get(hdr); val != "" {
+			headers[hdr] = val
+		}
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"id":        id,
+		"timestamp": time.Now().Unix(),
+		"tags":      []string{},
+		"headers":   headers,
+		"body": []interface{}{
+			map[string]interface{}{"id": 1, "content-type": "text/plain", "content": string(body)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	m, err := f.loadMessage(thread.id, data)
+	if err != nil {
+		return err
+	}
+
+	m.applyTagOps(tags)
+
+	thread.nodes = []*fakeNode{{msg: m}}
+	f.threads = append(f.threads, thread)
+
+	f.revision++
+
+	return nil
+}
+
+func (f *Fake) Revision() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return strconv.Itoa(f.revision), nil
+}
+
+// SetConfig sets the configuration item key to value
+func (f *Fake) SetConfig(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.config[key] = value
+}
+
+func (f *Fake) ConfigList() (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	res := make(map[string]string)
+	for k, v := range f.config {
+		res[k] = v
+	}
+
+	return res, nil
+}
+
+// fakeQuery is a parsed query for the Fake backend
+type fakeQuery interface {
+	match(*fakeMessage) bool
+}
+
+type fakeAll struct{}
+
+func (fakeAll) match(*fakeMessage) bool { return true }
+
+type fakeNot struct{ q fakeQuery }
+
+func (n fakeNot) match(m *fakeMessage) bool { return !n.q.match(m) }
+
+type fakeAnd []fakeQuery
+
+func (a fakeAnd) match(m *fakeMessage) bool {
+	for _, q := range a {
+		if !q.match(m) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type fakeOr []fakeQuery
+
+func (o fakeOr) match(m *fakeMessage) bool {
+	for _, q := range o {
+		if q.match(m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type fakeTerm struct {
+	prefix string
+	value  string
+}
+
+func (t fakeTerm) match(m *fakeMessage) bool {
+	contains := func(s string) bool {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(t.value))
+	}
+
+	switch t.prefix {
+	case "id":
+		return m.id == t.value
+	case "thread":
+		return m.thread == t.value
+	case "tag":
+		return m.tags[t.value]
+	case "from":
+		return contains(m.headers["From"])
+	case "subject":
+		return contains(m.headers["Subject"])
+	default:
+		return contains(m.headers["From"]) || contains(m.headers["Subject"])
+	}
+}
+
+// mentionsTag returns whether q contains the term tag:tag
+func mentionsTag(q fakeQuery, tag string) bool {
+	switch q := q.(type) {
+	case fakeTerm:
+		return q.prefix == "tag" && q.value == tag
+	case fakeNot:
+		return mentionsTag(q.q, tag)
+	case fakeAnd:
+		for _, sub := range q {
+			if mentionsTag(sub, tag) {
+				return true
+			}
+		}
+	case fakeOr:
+		for _, sub := range q {
+			if mentionsTag(sub, tag) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+var errFakeQuerySyntax = errors.New("query syntax error")
+
+// tokenizeFakeQuery splits query into parentheses and terms. Double quotes group whitespace into a term.
+func tokenizeFakeQuery(query string) ([]string, error) {
+	var (
+		tokens  []string
+		current strings.Builder
+		quoted  bool
+	)
+
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case quoted:
+			current.WriteRune(r)
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case r == ' ' || r == '\t' || r == '\n':
+			flush()
+		default:
+			current.WriteRune(r)
+		}
+	}
+
+	if quoted {
+		return nil, fmt.Errorf("%w: unterminated quote", errFakeQuerySyntax)
+	}
+
+	flush()
+
+	return tokens, nil
+}
+
+type fakeQueryParser struct {
+	tokens []string
+}
+
+func (p *fakeQueryParser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+
+	return p.tokens[0]
+}
+
+func (p *fakeQueryParser) next() string {
+	t := p.peek()
+	if len(p.tokens) > 0 {
+		p.tokens = p.tokens[1:]
+	}
+
+	return t
+}
+
+func (p *fakeQueryParser) parseOr() (fakeQuery, error) {
+	var res fakeOr
+
+	for {
+		q, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, q)
+
+		if p.peek() != "or" {
+			break
+		}
+
+		p.next()
+	}
+
+	if len(res) == 1 {
+		return res[0], nil
+	}
+
+	return res, nil
+}
+
+func (p *fakeQueryParser) parseAnd() (fakeQuery, error) {
+	var res fakeAnd
+
+	for {
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, q)
+
+		switch p.peek() {
+		case "and":
+			p.next()
+			continue
+		case "", "or", ")":
+		default:
+			// Implicit "and"
+			continue
+		}
+
+		break
+	}
+
+	if len(res) == 1 {
+		return res[0], nil
+	}
+
+	return res, nil
+}
+
+func (p *fakeQueryParser) parseUnary() (fakeQuery, error) {
+	tok := p.next()
+
+	switch tok {
+	case "":
+		return nil, fmt.Errorf("%w: unexpected end of query", errFakeQuerySyntax)
+	case "not":
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return fakeNot{q}, nil
+	case "(":
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.next() != ")" {
+			return nil, fmt.Errorf("%w: missing )", errFakeQuerySyntax)
+		}
+
+		return q, nil
+	case ")", "and", "or":
+		return nil, fmt.Errorf("%w: unexpected %q", errFakeQuerySyntax, tok)
+	case "*":
+		return fakeAll{}, nil
+	}
+
+	parts := strings.SplitN(tok, ":", 2)
+	if len(parts) == 1 {
+		return fakeTerm{value: tok}, nil
+	}
+
+	return fakeTerm{prefix: parts[0], value: parts[1]}, nil
+}
+
+// parseFakeQuery parses query for the given notmuch subcommand. Syntax errors are reported like the CLI backend
+// reports them.
+func parseFakeQuery(command string, query string) (fakeQuery, error) {
+	q, err := parseFakeQueryTokens(query)
+	if err != nil {
+		return nil, &Error{Kind: ErrQuerySyntax, Command: command, Err: err}
+	}
+
+	return q, nil
+}
+
+func parseFakeQueryTokens(query string) (fakeQuery, error) {
+	tokens, err := tokenizeFakeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%w: empty query", errFakeQuerySyntax)
+	}
+
+	p := fakeQueryParser{tokens: tokens}
+
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.tokens) != 0 {
+		return nil, fmt.Errorf("%w: unexpected %q", errFakeQuerySyntax, p.peek())
+	}
+
+	return q, nil
+}
@@ -0,0 +1,201 @@
+package notmuch
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func loadTestFake(t *testing.T) *Fake {
+	f, err := os.Open("test-data/threads.json")
+	require.NoError(t, err)
+	defer f.Close()
+
+	fake, err := LoadFake(f)
+	require.NoError(t, err)
+
+	return fake
+}
+
+func TestFake_Search(t *testing.T) {
+	fake := loadTestFake(t)
+
+	output, err := fake.search("tag:unread", SearchOptions{})
+	require.NoError(t, err)
+
+	var results []struct {
+		Thread  string
+		Subject string
+		Matched int
+		Total   int
+		Tags    []string
+	}
+	require.NoError(t, json.Unmarshal(output, &results))
+
+	require.Len(t, results, 2)
+	assert.Equal(t, "0000000000000001", results[0].Thread)
+	assert.Equal(t, "Stapler", results[0].Subject)
+	assert.Equal(t, 3, results[0].Matched)
+	assert.Equal(t, 4, results[0].Total)
+	assert.Equal(t, []string{"inbox", "unread"}, results[0].Tags)
+	assert.Equal(t, "0000000000000002", results[1].Thread)
+
+	output, err = fake.search("from:milton or from:dave", SearchOptions{Output: "messages"})
+	require.NoError(t, err)
+
+	var ids []string
+	require.NoError(t, json.Unmarshal(output, &ids))
+	assert.Equal(t, []string{"reply2@example.com", "lunch@example.com"}, ids)
+
+	r, err := fake.Search("*", SearchOptions{Output: "threads", Offset: 1, Limit: 5, Sort: "oldest-first"})
+	require.NoError(t, err)
+
+	ids = nil
+	require.NoError(t, json.NewDecoder(r).Decode(&ids))
+	require.NoError(t, r.Close())
+	assert.Equal(t, []string{"0000000000000001"}, ids)
+}
+
+func TestFake_Show(t *testing.T) {
+	fake := loadTestFake(t)
+
+	output, err := fake.Show("id:reply2@example.com", ShowOptions{})
+	require.NoError(t, err)
+
+	// Non-matching messages show up as null, but the structure is retained
+	var threads [][]json.RawMessage
+	require.NoError(t, json.Unmarshal(output, &threads))
+	require.Len(t, threads, 1)
+	assert.True(t, strings.HasPrefix(string(threads[0][0]), `[null,[[null,[[{`))
+	assert.NotContains(t, string(output), "stapler?")
+
+	output, err = fake.Show("thread:0000000000000001", ShowOptions{EntireThread: true, Body: true})
+	require.NoError(t, err)
+	assert.Contains(t, string(output), "stapler?")
+}
+
+func TestFake_Tag(t *testing.T) {
+	fake := loadTestFake(t)
+
+	count, err := fake.Count("tag:unread", CountOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 4, count)
+
+	rev, err := fake.Revision()
+	require.NoError(t, err)
+
+	require.NoError(t, fake.Tag([]string{"-unread", "+read"}, "thread:0000000000000001 and not from:carol"))
+
+	newRev, err := fake.Revision()
+	require.NoError(t, err)
+	assert.NotEqual(t, rev, newRev)
+
+	count, err = fake.Count("tag:unread", CountOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	count, err = fake.Count("tag:read and (from:bob or from:milton)", CountOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	assert.Error(t, fake.Tag([]string{"unread"}, "*"))
+}
+
+func TestFake_Raw(t *testing.T) {
+	fake := loadTestFake(t)
+
+	raw, err := fake.ShowRaw("reply1@example.com")
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), "From: Bob <bob@example.com>\n")
+	assert.Contains(t, string(raw), "\n\nYes, it's red.\n")
+
+	reply, err := fake.Reply("reply1@example.com")
+	require.NoError(t, err)
+	assert.Contains(t, string(reply), "Subject: Re: Stapler\n")
+	assert.Contains(t, string(reply), "> Yes, it's red.\n")
+
+	addrs, err := fake.Address("tag:inbox and not tag:unread")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Alice <alice@example.com>"}, addrs)
+}
+
+func TestFake_QuerySyntax(t *testing.T) {
+	fake := loadTestFake(t)
+
+	for _, q := range []string{"", "(tag:unread", "tag:unread and", `subject:"foo`} {
+		_, err := fake.Count(q, CountOptions{})
+		assert.True(t, errors.Is(err, &Error{Kind: ErrQuerySyntax}), "query %q: %v", q, err)
+	}
+}
+
+func TestFake_Insert(t *testing.T) {
+	fake := loadTestFake(t)
+
+	msg := "From: Alice <alice@example.com>\nTo: bob@example.com\nSubject: Sent\nMessage-ID: <sent@example.com>\n\nHello\n"
+
+	// A rejected message isn't added, so that it can be inserted again
+	assert.Error(t, fake.Insert("Sent", []string{"sent"}, []byte(msg)))
+	require.NoError(t, fake.Insert("Sent", []string{"+sent", "-inbox"}, []byte(msg)))
+
+	count, err := fake.Count("tag:sent and id:sent@example.com and subject:sent", CountOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	raw, err := fake.ShowRaw("sent@example.com")
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), "\n\nHello\n")
+}
+
+func TestFake_TagBatch(t *testing.T) {
+	fake := loadTestFake(t)
+
+	err := fake.TagBatch([]TagOp{
+		{Tags: []string{"-unread"}, Query: "id:reply1@example.com"},
+		{Tags: []string{"-unread"}, Query: "id:reply2@example.com and ("},
+		{Tags: []string{"+todo"}, Query: "thread:0000000000000002"},
+	})
+
+	var batchErr *BatchError
+	require.True(t, errors.As(err, &batchErr))
+	require.Len(t, batchErr.Failures, 1)
+	assert.Equal(t, 1, batchErr.Failures[0].Index)
+
+	count, err := fake.Count("tag:unread", CountOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	count, err = fake.Count("tag:todo", CountOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestFake_Excluded(t *testing.T) {
+	fake := loadTestFake(t)
+	fake.SetConfig("search.exclude_tags", "deleted;attachment;")
+
+	count, err := fake.Count("tag:unread", CountOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	count, err = fake.Count("tag:unread", CountOptions{IncludeExcluded: true})
+	require.NoError(t, err)
+	assert.Equal(t, 4, count)
+
+	// Tags mentioned in the query aren't excluded
+	count, err = fake.Count("tag:attachment", CountOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	output, err := fake.Show("id:lunch@example.com", ShowOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "[]", string(output))
+
+	output, err = fake.Show("id:lunch@example.com", ShowOptions{IncludeExcluded: true})
+	require.NoError(t, err)
+	assert.Contains(t, string(output), `"excluded":true`)
+}
@@ -0,0 +1,153 @@
+// Package notmuch provides access to a notmuch mail store.
+//
+// All interaction with the mail store goes through the Backend interface. CLI implements it by running the
+// notmuch command, Fake implements it on top of an in-memory set of threads, for example loaded from JSON
+// fixtures.
+package notmuch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SearchOptions controls the output of Backend.Search
+type SearchOptions struct {
+	// Output selects what is listed: "summary" (the default), "threads" or "messages"
+	Output string
+	// Limit is the maximum number of results. Zero means no limit.
+	Limit int
+	// Offset is the number of results to skip
+	Offset int
+	// Sort is either "newest-first" (the default) or "oldest-first"
+	Sort string
+	// IncludeExcluded also returns messages with tags from notmuch's search.exclude_tags setting
+	IncludeExcluded bool
+}
+
+// CountOptions controls which messages Backend.Count counts
+type CountOptions struct {
+	// IncludeExcluded also counts messages with tags from notmuch's search.exclude_tags setting
+	IncludeExcluded bool
+}
+
+// ShowOptions controls the output of Backend.Show
+type ShowOptions struct {
+	// EntireThread includes messages that don't match the query, but are in the same thread as a matching
+	// message
+	EntireThread bool
+	// Body includes message bodies in the output
+	Body bool
+	// IncludeHTML includes the content of text/html parts
+	IncludeHTML bool
+	// Decrypt decrypts encrypted messages if possible
+	Decrypt bool
+	// IncludeExcluded also matches messages with tags from notmuch's search.exclude_tags setting
+	IncludeExcluded bool
+}
+
+// TagOp is a set of tag changes (+tag, -tag) for the messages matching Query
+type TagOp struct {
+	Tags  []string
+	Query string
+}
+
+// BatchFailure describes an operation passed to Backend.TagBatch that couldn't be applied
+type BatchFailure struct {
+	Index   int // Index of Op in the list of operations
+	Op      TagOp
+	Message string
+}
+
+// BatchError is returned by Backend.TagBatch if some of the operations failed. If notmuch itself failed as well, Err
+// is the reason, and it is unknown which of the other operations were applied.
+type BatchError struct {
+	Failures []BatchFailure
+	Err      error
+}
+
+func (e *BatchError) Error() string {
+	var lines []string
+
+	for _, f := range e.Failures {
+		lines = append(lines, fmt.Sprintf("%s -- %s: %s", strings.Join(f.Op.Tags, " "), f.Op.Query, f.Message))
+	}
+
+	msg := fmt.Sprintf("%d tag operations failed:\n%s", len(e.Failures), strings.Join(lines, "\n"))
+	if e.Err != nil {
+		msg = e.Err.Error() + "\n" + msg
+	}
+
+	return msg
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// CheckTagOps makes sure that every element of tags is of the form +tag or -tag
+func CheckTagOps(tags []string) error {
+	for _, t := range tags {
+		if len(t) < 2 || (t[0] != '+' && t[0] != '-') {
+			return fmt.Errorf("%q is not a tag change, expected +tag or -tag", t)
+		}
+	}
+
+	return nil
+}
+
+// checkTagOp makes sure that op has a query and that every tag change is of the form +tag or -tag
+func checkTagOp(op TagOp) error {
+	if strings.TrimSpace(op.Query) == "" {
+		return errors.New("empty query")
+	}
+
+	if len(op.Tags) == 0 {
+		return errors.New("no tag changes")
+	}
+
+	return CheckTagOps(op.Tags)
+}
+
+// Backend is the interface to the mail store. Methods returning []byte return the JSON (or, in the case of
+// ShowRaw and Reply, plain text) output of the corresponding notmuch command.
+type Backend interface {
+	// Search runs the given query and returns a reader for the results as a JSON list, so that they can be
+	// decoded while notmuch is still producing them. Errors from running the query may be returned from Close,
+	// which must always be called.
+	Search(query string, opts SearchOptions) (io.ReadCloser, error)
+
+	// Show returns the threads matching query in the format of `notmuch show --format=json`
+	Show(query string, opts ShowOptions) ([]byte, error)
+
+	// ShowRaw returns the unmodified RFC 5322 source of the message with the given message ID
+	ShowRaw(messageID string) ([]byte, error)
+
+	// Tag applies the given tag changes (+tag, -tag) to all messages matching query
+	Tag(tags []string, query string) error
+
+	// TagBatch applies many tag changes at once. Operations that fail don't keep the others from being applied,
+	// they are reported in a *BatchError.
+	TagBatch(ops []TagOp) error
+
+	// Reply returns a reply template for the message with the given message ID
+	Reply(messageID string) ([]byte, error)
+
+	// Count returns the number of messages matching query
+	Count(query string, opts CountOptions) (int, error)
+
+	// Address returns the sender addresses of all messages matching query
+	Address(query string) ([]string, error)
+
+	// Insert adds msg to the mail store, in the given maildir folder (relative to the database root), and
+	// applies the given tag changes to it
+	Insert(folder string, tags []string, msg []byte) error
+
+	// ConfigList returns notmuch's configuration as a map of keys (e.g. "query.inbox") to values
+	ConfigList() (map[string]string, error)
+
+	// Revision returns a value that changes whenever the database is modified. It is only useful to compare it
+	// with earlier revisions.
+	Revision() (string, error)
+}
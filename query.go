@@ -3,16 +3,17 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os/exec"
+	"io"
 	"regexp"
 	"strings"
 	"sync"
 
 	"9fans.net/go/acme"
-)
 
-const _maxSubjectLen = 60
+	"github.com/farhaven/acme-notmuch/notmuch"
+)
 
 type QueryResult struct {
 	Thread       string
@@ -27,42 +28,275 @@ type QueryResult struct {
 
 func (q QueryResult) String() string {
 	subject := q.Subject
-	if len(subject) > _maxSubjectLen {
-		subject = subject[:_maxSubjectLen] + "..."
+	if len(subject) > _config.Query.MaxSubjectLen {
+		subject = subject[:_config.Query.MaxSubjectLen] + "..."
 	}
 
 	return fmt.Sprintf("%s\t(%d/%d)\t%s\t%v", q.Thread, q.Matched, q.Total, subject, q.Tags)
 }
 
-func refreshQueryResult(win *acme.Win, query string) error {
-	win.Clear()
+// queryOptions are the options that can be given in front of a query, e.g. "Query -oldest tag:inbox"
+type queryOptions struct {
+	oldestFirst bool // -oldest, -newest
+	all         bool // -all: don't omit messages with excluded tags
+	messages    bool // -messages: list messages instead of threads
+}
+
+// parseQuery splits the options from the start of arg and returns them together with the remaining query. Options
+// end at the first word that isn't one, or at "--".
+func parseQuery(arg string) (queryOptions, string) {
+	var opts queryOptions
+
+	words := strings.Fields(arg)
+
+	for len(words) > 0 {
+		switch words[0] {
+		case "-oldest":
+			opts.oldestFirst = true
+		case "-newest":
+			opts.oldestFirst = false
+		case "-all":
+			opts.all = true
+		case "-messages":
+			opts.messages = true
+		case "--":
+			words = words[1:]
+			return opts, strings.Join(words, " ")
+		default:
+			return opts, strings.Join(words, " ")
+		}
+
+		words = words[1:]
+	}
+
+	return opts, ""
+}
+
+// args returns the options in the form that parseQuery understands
+func (o queryOptions) args() []string {
+	var args []string
+
+	if o.oldestFirst {
+		args = append(args, "-oldest")
+	}
+
+	if o.all {
+		args = append(args, "-all")
+	}
+
+	if o.messages {
+		args = append(args, "-messages")
+	}
+
+	return args
+}
+
+func (o queryOptions) searchOptions() notmuch.SearchOptions {
+	opts := notmuch.SearchOptions{
+		Output:          "summary",
+		IncludeExcluded: o.all,
+	}
+
+	if o.oldestFirst {
+		opts.Sort = "oldest-first"
+	}
+
+	if o.messages {
+		opts.Output = "messages"
+	}
+
+	return opts
+}
+
+// String describes the options for the header line of query windows
+func (o queryOptions) String() string {
+	var desc []string
+
+	if o.oldestFirst {
+		desc = append(desc, "oldest first")
+	} else {
+		desc = append(desc, "newest first")
+	}
+
+	if o.all {
+		desc = append(desc, "including excluded")
+	}
+
+	if o.messages {
+		desc = append(desc, "messages")
+	} else {
+		desc = append(desc, "threads")
+	}
+
+	return strings.Join(desc, ", ")
+}
+
+// _flushResults is the number of results that are collected before they are written to the window
+const _flushResults = 100
+
+// queryWindow holds the state of a window showing query results
+type queryWindow struct {
+	win   *acme.Win
+	nm    notmuch.Backend
+	query string
+	opts  queryOptions
+
+	// messages and messageIDs are the listed messages if opts.messages is set, results are the listed threads
+	// otherwise
+	messages   []string
+	messageIDs map[string]bool
+	results    []QueryResult
+
+	// loaded is the number of results shown in the window, exhausted is set once the last page has been loaded
+	loaded    int
+	exhausted bool
+}
+
+// writeResults prints a batch of result lines to the end of the window body
+func (q *queryWindow) writeResults(lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+
+	q.win.PrintTabbed(strings.Join(lines, "\n"))
+}
+
+// loadPage runs the query for the next page of results and appends them to the window as they are decoded
+func (q *queryWindow) loadPage() error {
+	opts := q.opts.searchOptions()
+	opts.Limit = _config.Query.PageSize
+	opts.Offset = q.loaded
 
-	err := win.Fprintf("data", "Results of query %q\n\n", query)
+	r, err := q.nm.Search(q.query, opts)
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.Command("notmuch", "search", "--output=summary", "--format=json", query)
+	count, err := q.decodeResults(r)
+
+	closeErr := r.Close()
+	if closeErr != nil {
+		return closeErr
+	}
 
-	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return err
 	}
 
-	var results []QueryResult
-	err = json.Unmarshal(output, &results)
+	if count < _config.Query.PageSize {
+		q.exhausted = true
+	}
+
+	return nil
+}
+
+// decodeResults decodes the JSON list of results from r and writes them to the window in batches. It returns the
+// number of results that were decoded.
+func (q *queryWindow) decodeResults(r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+
+	_, err := dec.Token()
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("reading start of results: %w", err)
 	}
 
-	var res []string
-	for _, r := range results {
-		res = append(res, r.String())
+	var (
+		count int
+		batch []string
+	)
+
+	for dec.More() {
+		var line string
+
+		if q.opts.messages {
+			// Message listings are just the message IDs
+			err = dec.Decode(&line)
+		} else {
+			var res QueryResult
+			err = dec.Decode(&res)
+			line = res.String()
+
+			if err == nil {
+				q.results = append(q.results, res)
+			}
+		}
+
+		if err != nil {
+			q.writeResults(batch)
+			return count, fmt.Errorf("decoding result %d: %w", q.loaded, err)
+		}
+
+		if q.opts.messages {
+			q.messages = append(q.messages, line)
+			q.messageIDs[line] = true
+		}
+
+		batch = append(batch, line)
+		count++
+		q.loaded++
+
+		if len(batch) == _flushResults {
+			q.writeResults(batch)
+			batch = batch[:0]
+		}
 	}
 
-	win.PrintTabbed(strings.Join(res, "\n"))
+	q.writeResults(batch)
 
-	err = winClean(win)
+	_, err = dec.Token()
+	if err != nil {
+		return count, fmt.Errorf("reading end of results: %w", err)
+	}
+
+	return count, nil
+}
+
+func (q *queryWindow) header() string {
+	return fmt.Sprintf("Results of query %q (%s)\n\n", q.query, q.opts)
+}
+
+func (q *queryWindow) writeHeader() error {
+	return q.win.Fprintf("data", "%s", q.header())
+}
+
+// lines returns the lines of the listing
+func (q *queryWindow) lines() []string {
+	if q.opts.messages {
+		return q.messages
+	}
+
+	var lines []string
+	for _, r := range q.results {
+		lines = append(lines, r.String())
+	}
+
+	return lines
+}
+
+// refresh clears the window and shows the first page of results
+func (q *queryWindow) refresh() error {
+	q.win.Clear()
+	q.loaded = 0
+	q.exhausted = false
+	q.messages = nil
+	q.messageIDs = make(map[string]bool)
+	q.results = nil
+
+	err := q.writeHeader()
+	if err != nil {
+		return err
+	}
+
+	err = q.loadPage()
+	if err != nil {
+		// Show what went wrong in the window itself, so that it isn't just empty
+		q.win.Fprintf("data", "%s\n", describeError(err))
+		winClean(q.win)
+
+		return err
+	}
+
+	err = winClean(q.win)
 	if err != nil {
 		return err
 	}
@@ -70,39 +304,405 @@ func refreshQueryResult(win *acme.Win, query string) error {
 	return nil
 }
 
+// more appends the next page of results to the window
+func (q *queryWindow) more() error {
+	if q.exhausted {
+		return errors.New("no more results")
+	}
+
+	err := q.loadPage()
+	if err != nil {
+		return err
+	}
+
+	return q.win.Ctl("clean")
+}
+
+// redraw replaces the listing with the current results. Only the lines that changed are rewritten, and dot is kept
+// where it was.
+func (q *queryWindow) redraw() error {
+	q0, q1, err := dot(q.win)
+	if err != nil {
+		return err
+	}
+
+	err = replaceBody(q.win, q.header()+formatTabbed(q.win, strings.Join(q.lines(), "\n")))
+	if err != nil {
+		return err
+	}
+
+	return setDot(q.win, q0, q1)
+}
+
+// reload re-runs the query for the results that are loaded and updates the listing if they changed
+func (q *queryWindow) reload() error {
+	opts := q.opts.searchOptions()
+	opts.Limit = q.loaded
+	if opts.Limit < _config.Query.PageSize {
+		opts.Limit = _config.Query.PageSize
+	}
+
+	var (
+		messages []string
+		results  []QueryResult
+		err      error
+	)
+
+	if q.opts.messages {
+		err = decodeSearch(q.nm, q.query, opts, &messages)
+	} else {
+		err = decodeSearch(q.nm, q.query, opts, &results)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	old := q.lines()
+
+	q.messages = messages
+	q.messageIDs = make(map[string]bool)
+	for _, id := range messages {
+		q.messageIDs[id] = true
+	}
+
+	q.results = results
+	q.loaded = len(messages) + len(results)
+	q.exhausted = q.loaded < opts.Limit
+
+	if strings.Join(q.lines(), "\n") == strings.Join(old, "\n") {
+		return nil
+	}
+
+	return q.redraw()
+}
+
+// update reloads the results, unless the window was edited
+func (q *queryWindow) update() error {
+	dirty, err := isDirty(q.win)
+	if err != nil || dirty {
+		return err
+	}
+
+	return q.reload()
+}
+
+// updateThreads fetches the current state of the given threads and updates their lines in the listing, without
+// re-running the whole query
+func (q *queryWindow) updateThreads(threadIDs []string) error {
+	if q.opts.messages || len(threadIDs) == 0 {
+		// Message listings only show IDs, which don't change
+		return nil
+	}
+
+	opts := q.opts.searchOptions()
+
+	for _, id := range threadIDs {
+		var results []QueryResult
+
+		err := decodeSearch(q.nm, "thread:"+id+" and ("+q.query+")", opts, &results)
+		if err != nil {
+			return err
+		}
+
+		if len(results) == 0 {
+			// The thread doesn't match the query anymore. Keep it in the listing, but show that.
+			err = decodeSearch(q.nm, "thread:"+id, opts, &results)
+			if err != nil {
+				return err
+			}
+
+			for idx := range results {
+				results[idx].Matched = 0
+			}
+		}
+
+		if len(results) != 1 {
+			return fmt.Errorf("thread %s: expected one result, got %d", id, len(results))
+		}
+
+		for idx := range q.results {
+			if q.results[idx].Thread == id {
+				q.results[idx] = results[0]
+			}
+		}
+	}
+
+	return q.redraw()
+}
+
+// selection returns queries for the threads or messages on the lines touched by dot
+func (q *queryWindow) selection() ([]string, []string, error) {
+	lines, err := selectedLines(q.win)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var queries, threadIDs []string
+
+	for _, line := range lines {
+		if q.opts.messages {
+			id := strings.TrimSpace(line)
+			if q.messageIDs[id] {
+				queries = append(queries, "id:"+id)
+			}
+
+			continue
+		}
+
+		id := _threadLineRegex.FindStringSubmatch(line)
+		if id == nil {
+			continue
+		}
+
+		threadIDs = append(threadIDs, id[1])
+		queries = append(queries, "thread:"+id[1])
+	}
+
+	if len(queries) == 0 {
+		return nil, nil, errors.New("no thread or message selected")
+	}
+
+	return queries, threadIDs, nil
+}
+
+// tag applies the tag changes to the selected threads or messages. The listing is updated through the bus, like all
+// other open windows.
+func (q *queryWindow) tag(tags []string) error {
+	if len(tags) == 0 {
+		return errors.New("no tags given")
+	}
+
+	queries, _, err := q.selection()
+	if err != nil {
+		return err
+	}
+
+	return tagEach(q.nm, tags, queries)
+}
+
+// read removes the "unread" tag from all messages of the selected threads, or of the threads of the selected
+// messages
+func (q *queryWindow) read() error {
+	queries, threadIDs, err := q.selection()
+	if err != nil {
+		return err
+	}
+
+	if q.opts.messages {
+		for _, query := range queries {
+			id, err := threadOf(q.nm, strings.TrimPrefix(query, "id:"))
+			if err != nil {
+				return err
+			}
+
+			threadIDs = append(threadIDs, id)
+		}
+	}
+
+	var threads []string
+	for _, id := range threadIDs {
+		threads = append(threads, "thread:"+id)
+	}
+
+	return tagEach(q.nm, []string{"-unread"}, threads)
+}
+
+// handleTagEvent updates the lines of the listed threads that are affected by e
+func (q *queryWindow) handleTagEvent(e tagEvent) error {
+	var threadIDs []string
+
+	for _, r := range q.results {
+		if e.hasThread(r.Thread) {
+			threadIDs = append(threadIDs, r.Thread)
+		}
+	}
+
+	return q.updateThreads(threadIDs)
+}
+
+// decodeSearch runs query and decodes the complete list of results into v
+func decodeSearch(nm notmuch.Backend, query string, opts notmuch.SearchOptions, v interface{}) error {
+	r, err := nm.Search(query, opts)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewDecoder(r).Decode(v)
+
+	closeErr := r.Close()
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return err
+}
+
 // Thread ID: sequence of 16 hex digits
 var _threadIDRegex = regexp.MustCompile("[0-9a-f]{16}")
 
-// displayQueryResult opens a new window that shows the results of query
-func displayQueryResult(wg *sync.WaitGroup, query string) error {
+// _threadLineRegex matches lines of thread listings and captures the thread ID
+var _threadLineRegex = regexp.MustCompile("^([0-9a-f]{16})\t")
+
+// displayQueryResult opens a new window that shows the results of query. The query may be preceded by options,
+// see parseQuery.
+func displayQueryResult(wg *sync.WaitGroup, nm notmuch.Backend, query string) error {
 	defer wg.Done()
 
-	win, err := newWin("/Mail/query", "Get")
+	opts, query := parseQuery(query)
+
+	reg := _windows.open("query", queryWindowKey(opts, query))
+	if reg == nil {
+		// Already open
+		return nil
+	}
+	defer _windows.close(reg)
+
+	win, err := newWin(_windows.name(reg, queryWindowName(opts, query)), "Get More Tag Read Archive Delete")
 	if err != nil {
 		return err
 	}
 
-	err = refreshQueryResult(win, query)
+	q := &queryWindow{
+		win:   win,
+		nm:    warnTo(nm, win),
+		query: query,
+		opts:  opts,
+	}
+
+	err = q.refresh()
 	if err != nil {
-		return err
+		win.Errf("can't run query %q: %s", query, err)
 	}
 
-	for evt := range win.EventChan() {
+	sub := _bus.subscribe()
+	defer _bus.cancel(sub)
+
+	events := win.EventChan()
+
+	for {
+		var evt *acme.Event
+
+		select {
+		case e := <-sub.C:
+			switch e := e.(type) {
+			case tagEvent:
+				err := q.handleTagEvent(e)
+				if err != nil {
+					win.Errf("can't update listing: %s", err)
+				}
+			case dbChanged:
+				err := q.update()
+				if err != nil {
+					win.Errf("can't update listing: %s", err)
+				}
+			}
+
+			continue
+		case <-reg.Raise:
+			err := win.Ctl("show")
+			if err == nil {
+				err = q.update()
+			}
+
+			if err != nil {
+				win.Errf("can't update listing: %s", err)
+			}
+
+			continue
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+
+			evt = ev
+		}
+
 		// Only listen to l and L events to catch right click on a thread ID
 		// x and X go right back to acme
 		switch evt.C2 {
 		case 'l', 'L':
 		case 'x', 'X':
-			if string(evt.Text) == "Get" {
-				err = refreshQueryResult(win, query)
+			cmd, arg := getCommandArgs(evt)
+
+			switch cmd {
+			case "Get":
+				// Options or a new query given to Get replace the ones of the window
+				if arg != "" {
+					opts, query := parseQuery(arg)
+					if query == "" {
+						query = q.query
+					}
+
+					if !_windows.rekey(reg, "query", queryWindowKey(opts, query)) {
+						win.Errf("query %q is already shown in another window", query)
+						continue
+					}
+
+					q.opts = opts
+					q.query = query
+
+					err = win.Name("%s", _windows.name(reg, queryWindowName(opts, query)))
+					if err != nil {
+						win.Errf("can't rename window: %s", err)
+					}
+				}
+
+				err = q.refresh()
 				if err != nil {
 					win.Errf("can't refresh query window: %s", err)
 				}
 
+				continue
+			case "More":
+				err = q.more()
+				if err != nil {
+					win.Errf("can't load more results: %s", err)
+				}
+
+				continue
+			case "Tag":
+				err = q.tag(strings.Fields(arg))
+				if err != nil {
+					win.Errf("can't update tags: %s", err)
+				}
+
+				continue
+			case "Read":
+				err = q.read()
+				if err != nil {
+					win.Errf("can't mark threads as read: %s", err)
+				}
+
+				continue
+			case "Spam", "Ham":
+				queries, _, err := q.selection()
+				if err == nil {
+					err = markSpam(q.nm, queries, cmd == "Spam")
+				}
+
+				if err != nil {
+					win.Errf("can't mark selection as %s: %s", strings.ToLower(cmd), err)
+				}
+
+				continue
+			case "Delete":
+				err = q.tag(_config.Delete.Tags)
+				if err != nil {
+					win.Errf("can't delete: %s", err)
+				}
+
+				continue
+			case "Archive":
+				err = q.tag(_config.Archive.Tags)
+				if err != nil {
+					win.Errf("can't archive: %s", err)
+				}
+
 				continue
 			}
 
-			err := handleCommand(wg, win, evt)
+			err := handleCommand(wg, q.nm, win, evt)
 			switch err {
 			case nil:
 				// Nothing to do, event already handled
@@ -119,9 +719,29 @@ func displayQueryResult(wg *sync.WaitGroup, query string) error {
 			continue
 		}
 
+		// Short message IDs from other windows
+		if look(wg, q.nm, string(evt.Text), "") == nil {
+			continue
+		}
+
 		// Match thread IDs: Sequence of 16 hex digits, followed by optional whitespace
 		id := bytes.Trim(evt.Text, " \r\t\n")
 
+		if q.opts.messages {
+			if !q.messageIDs[string(id)] {
+				err := win.WriteEvent(evt)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			wg.Add(1)
+			go displayMessage(wg, q.nm, string(id), queryWindowKey(q.opts, q.query))
+
+			continue
+		}
+
 		if !_threadIDRegex.Match(id) {
 			// Doesn't look like a thread ID, send it back to ACME
 			err := win.WriteEvent(evt)
@@ -133,8 +753,6 @@ func displayQueryResult(wg *sync.WaitGroup, query string) error {
 
 		wg.Add(1)
 		// Open thread in new window
-		go displayThread(wg, string(id))
+		go displayThread(wg, q.nm, string(id), queryWindowKey(q.opts, q.query), "")
 	}
-
-	return nil
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// windowKey identifies what a window shows, e.g. {"thread", "0000000000000001"}
+type windowKey struct {
+	Kind string
+	ID   string
+}
+
+// openWindow is an entry in the registry of open windows. Raise receives a value when something tries to open the
+// window again, the window should then show itself and refresh its content.
+type openWindow struct {
+	key   windowKey
+	name  string
+	Raise chan struct{}
+}
+
+// registry keeps track of the open windows, so that opening something that is already shown reuses its window. It
+// is safe for concurrent use.
+type registry struct {
+	mu    sync.Mutex
+	wins  map[windowKey]*openWindow
+	names map[string]*openWindow
+}
+
+var _windows = &registry{}
+
+// raise tells w to show itself. Raises that arrive while w is busy are merged.
+func (w *openWindow) raise() {
+	select {
+	case w.Raise <- struct{}{}:
+	default:
+	}
+}
+
+// open registers a window showing the thing identified by kind and id. If a window for it is open already, it is
+// raised instead and nil is returned.
+func (r *registry) open(kind, id string) *openWindow {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.wins == nil {
+		r.wins = make(map[windowKey]*openWindow)
+		r.names = make(map[string]*openWindow)
+	}
+
+	key := windowKey{Kind: kind, ID: id}
+
+	if w, ok := r.wins[key]; ok {
+		w.raise()
+		return nil
+	}
+
+	w := &openWindow{
+		key:   key,
+		Raise: make(chan struct{}, 1),
+	}
+
+	r.wins[key] = w
+
+	return w
+}
+
+// isOpen returns true if a window shows the thing identified by kind and id
+func (r *registry) isOpen(kind, id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.wins[windowKey{Kind: kind, ID: id}]
+
+	return ok
+}
+
+// rekey changes what w shows, e.g. after the query of a query window was changed. If another window already shows
+// it, that window is raised and false is returned.
+func (r *registry) rekey(w *openWindow, kind, id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := windowKey{Kind: kind, ID: id}
+	if key == w.key {
+		return true
+	}
+
+	if other, ok := r.wins[key]; ok {
+		other.raise()
+		return false
+	}
+
+	delete(r.wins, w.key)
+	w.key = key
+	r.wins[key] = w
+
+	return true
+}
+
+// name returns a window name starting with base that isn't used by any other open window, and reserves it for w
+func (r *registry) name(w *openWindow, base string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[w.name] == w {
+		delete(r.names, w.name)
+	}
+
+	name := base
+	for n := 2; r.names[name] != nil; n++ {
+		name = base + "<" + strconv.Itoa(n) + ">"
+	}
+
+	w.name = name
+	r.names[name] = w
+
+	return name
+}
+
+// close removes w from the registry
+func (r *registry) close(w *openWindow) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.wins[w.key] == w {
+		delete(r.wins, w.key)
+	}
+
+	if r.names[w.name] == w {
+		delete(r.names, w.name)
+	}
+}
+
+// queryWindowKey returns the ID of query windows in the registry
+func queryWindowKey(opts queryOptions, query string) string {
+	return strings.Join(append(opts.args(), query), " ")
+}
+
+// queryWindowName returns the name for a window showing query, e.g. /Mail/query/tag:inbox_and_tag:unread. Spaces
+// would make acme treat the rest of the name as tag commands, so they are replaced.
+func queryWindowName(opts queryOptions, query string) string {
+	words := append(opts.args(), strings.Fields(query)...)
+	if len(words) == 0 {
+		words = []string{"*"}
+	}
+
+	return "/Mail/query/" + strings.Join(words, "_")
+}
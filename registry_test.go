@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	var r registry
+
+	w := r.open("thread", "0000000000000001")
+	require.NotNil(t, w)
+
+	// Opening it again raises the existing window
+	assert.Nil(t, r.open("thread", "0000000000000001"))
+	assert.Len(t, w.Raise, 1)
+
+	q1 := r.open("query", "tag:inbox")
+	q2 := r.open("query", "tag:inbox and tag:unread")
+	require.NotNil(t, q1)
+	require.NotNil(t, q2)
+
+	assert.Equal(t, "/Mail/query/tag:inbox", r.name(q1, "/Mail/query/tag:inbox"))
+	assert.Equal(t, "/Mail/query/tag:inbox<2>", r.name(q2, "/Mail/query/tag:inbox"))
+
+	// The query of a window can't be changed to one that is shown already
+	assert.False(t, r.rekey(q2, "query", "tag:inbox"))
+	assert.Len(t, q1.Raise, 1)
+	assert.True(t, r.rekey(q2, "query", "tag:spam"))
+
+	r.close(w)
+	assert.NotNil(t, r.open("thread", "0000000000000001"))
+}
+
+func TestQueryWindowName(t *testing.T) {
+	opts, query := parseQuery("-oldest -messages tag:inbox and  not tag:spam")
+
+	assert.Equal(t, "/Mail/query/-oldest_-messages_tag:inbox_and_not_tag:spam", queryWindowName(opts, query))
+	assert.Equal(t, "/Mail/query/*", queryWindowName(queryOptions{}, ""))
+}
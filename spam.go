@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/farhaven/acme-notmuch/notmuch"
+)
+
+// trainClassifier pipes the raw message with the given ID into cmd
+func trainClassifier(nm notmuch.Backend, cmd []string, messageID string) error {
+	raw, err := nm.ShowRaw(messageID)
+	if err != nil {
+		return err
+	}
+
+	c := exec.Command(cmd[0], cmd[1:]...)
+	c.Stdin = bytes.NewReader(raw)
+
+	output, err := c.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("can't run %s: %q: %w", cmd[0], output, err)
+	}
+
+	return nil
+}
+
+// markSpam trains the classifier with the messages matching queries as spam, or as ham if spam is false, and tags
+// them accordingly. Messages that were classified the other way before are corrected, messages that already are
+// classified as requested are skipped.
+func markSpam(nm notmuch.Backend, queries []string, spam bool) error {
+	sets, err := messageTags(nm, queries)
+	if err != nil {
+		return err
+	}
+
+	var (
+		ops  []messageTagOp
+		errs []string
+	)
+
+	for _, set := range sets {
+		var (
+			cmd  []string
+			tags []string
+		)
+
+		switch {
+		case spam && set.Tags[_config.Spam.SpamTag], !spam && set.Tags[_config.Spam.HamTag]:
+			// Nothing to do
+			continue
+		case spam && set.Tags[_config.Spam.HamTag]:
+			cmd = _config.Spam.HamToSpam
+		case spam:
+			cmd = _config.Spam.Spam
+		case set.Tags[_config.Spam.SpamTag]:
+			cmd = _config.Spam.SpamToHam
+		default:
+			cmd = _config.Spam.Ham
+		}
+
+		if spam {
+			tags = []string{"+" + _config.Spam.SpamTag, "-" + _config.Spam.HamTag}
+		} else {
+			tags = []string{"+" + _config.Spam.HamTag, "-" + _config.Spam.SpamTag}
+		}
+
+		err = trainClassifier(nm, cmd, set.MsgID)
+		if err != nil {
+			errs = append(errs, set.MsgID+": "+err.Error())
+			continue
+		}
+
+		ops = append(ops, messageTagOp{Current: set, Tags: tags})
+	}
+
+	_, err = applyMessageTags(nm, ops, 0)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+
+	return nil
+}
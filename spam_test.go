@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarkSpam(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spam")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(c config) { _config = c }(_config)
+
+	fake, restore := setupTagTest(t)
+	defer restore()
+
+	// Record which command each message was piped into
+	log := filepath.Join(dir, "log")
+	record := func(name string) []string {
+		return []string{"sh", "-c", "grep -m 1 '^Message-I[dD]:' | sed 's/^/" + name + " /' >> " + log}
+	}
+
+	_config.Spam.Spam = record("spam")
+	_config.Spam.Ham = record("ham")
+	_config.Spam.SpamToHam = record("spam-to-ham")
+	_config.Spam.HamToSpam = record("ham-to-spam")
+
+	// notmuch's default, messages that are already tagged as spam still have to be found to correct them
+	fake.SetConfig("search.exclude_tags", "deleted;spam")
+
+	require.NoError(t, markSpam(fake, []string{"id:lunch@example.com"}, true))
+	require.NoError(t, markSpam(fake, []string{"id:lunch@example.com"}, true))
+	require.NoError(t, markSpam(fake, []string{"thread:0000000000000002"}, false))
+	require.NoError(t, markSpam(fake, []string{"id:lunch@example.com"}, true))
+
+	output, err := ioutil.ReadFile(log)
+	require.NoError(t, err)
+
+	assert.Equal(t, "spam Message-ID: <lunch@example.com>\n"+
+		"spam-to-ham Message-ID: <lunch@example.com>\n"+
+		"ham-to-spam Message-ID: <lunch@example.com>\n", string(output))
+
+	assert.Equal(t, 1, countMessages(t, fake, "tag:spam and not tag:ham"))
+}
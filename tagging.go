@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/farhaven/acme-notmuch/notmuch"
+)
+
+/* All tag changes go through applyMessageTags, which resolves the affected messages first so that the tags before
+and after the change can be recorded in the journal. That way, every change can be undone later. Automatic changes,
+like those for new messages in muted threads, aren't recorded, so that Undo always reverts what the user did. The
+changes are published on the bus afterwards, so that all open windows showing the messages can update themselves.
+*/
+
+// _unrecorded is passed to applyMessageTags instead of the ID of an undone group for changes that aren't recorded in
+// the journal
+const _unrecorded int64 = -1
+
+// _queryChunk is the number of queries that are combined into a single query, so that the notmuch command line
+// stays below the system's limit for the length of arguments
+const _queryChunk = 100
+
+// chunkQueries combines queries into "or" queries of at most _queryChunk terms each
+func chunkQueries(queries []string) []string {
+	var res []string
+
+	for len(queries) > 0 {
+		n := len(queries)
+		if n > _queryChunk {
+			n = _queryChunk
+		}
+
+		var terms []string
+		for _, q := range queries[:n] {
+			terms = append(terms, "("+q+")")
+		}
+
+		res = append(res, strings.Join(terms, " or "))
+		queries = queries[n:]
+	}
+
+	return res
+}
+
+// messageTags returns the IDs and current tags of all messages matching any of the queries
+func messageTags(nm notmuch.Backend, queries []string) ([]TagSet, error) {
+	var (
+		res  []TagSet
+		seen = make(map[string]bool)
+	)
+
+	for _, query := range chunkQueries(queries) {
+		// Like notmuch tag, changes apply to excluded messages (e.g. deleted ones) as well
+		output, err := nm.Show(query, notmuch.ShowOptions{IncludeExcluded: true})
+		if err != nil {
+			return nil, err
+		}
+
+		threads, err := parseThreads(output)
+		if err != nil {
+			return nil, fmt.Errorf("decoding messages: %w", err)
+		}
+
+		for _, thread := range threads {
+			for _, n := range thread.PreOrder() {
+				// Messages that don't match the query are null
+				if n.Message == nil || seen[n.Message.ID] {
+					continue
+				}
+
+				seen[n.Message.ID] = true
+				res = append(res, n.Message.TagSet())
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// messageTagOp is a list of tag changes for a single message
+type messageTagOp struct {
+	Current TagSet
+	Tags    []string
+}
+
+// applyMessageTags applies the tag changes, records them in the journal and tells open windows about them. If the
+// changes undo an earlier group of changes, undoes is its ID, _unrecorded keeps them out of the journal. Messages
+// whose tags don't change are skipped. It returns the changes that were made, even if some of them failed.
+func applyMessageTags(nm notmuch.Backend, ops []messageTagOp, undoes int64) ([]tagChange, error) {
+	var (
+		batch   []notmuch.TagOp
+		changes []tagChange
+	)
+
+	for _, op := range ops {
+		after := make(map[string]bool)
+		for t := range op.Current.Tags {
+			after[t] = true
+		}
+
+		for _, t := range op.Tags {
+			if strings.HasPrefix(t, "+") {
+				after[t[1:]] = true
+			} else {
+				delete(after, t[1:])
+			}
+		}
+
+		change := tagChange{
+			ID:     op.Current.MsgID,
+			Before: sortedTags(op.Current.Tags),
+			After:  sortedTags(after),
+		}
+
+		if len(change.ops()) == 0 {
+			continue
+		}
+
+		batch = append(batch, notmuch.TagOp{Tags: op.Tags, Query: "id:" + change.ID})
+		changes = append(changes, change)
+	}
+
+	var err error
+
+	if len(batch) != 0 {
+		err = nm.TagBatch(batch)
+	}
+
+	var batchErr *notmuch.BatchError
+	if err != nil && (!errors.As(err, &batchErr) || batchErr.Err != nil) {
+		// Nothing was changed, or notmuch failed and it's unknown what was
+		return nil, err
+	}
+
+	if batchErr != nil {
+		failed := make(map[int]bool)
+		for _, f := range batchErr.Failures {
+			failed[f.Index] = true
+		}
+
+		var applied []tagChange
+		for idx, c := range changes {
+			if !failed[idx] {
+				applied = append(applied, c)
+			}
+		}
+
+		changes = applied
+	}
+
+	// An undo is recorded even if nothing changed, so that the undone group isn't offered again
+	if undoes != _unrecorded && (len(changes) != 0 || undoes != 0) {
+		_, jErr := _journal.record(changes, undoes)
+		if jErr != nil {
+			return changes, fmt.Errorf("tags changed, but can't record the change in the journal: %w", jErr)
+		}
+	}
+
+	if len(changes) != 0 {
+		notifyErr := notifyTagChanges(nm, changes)
+		if notifyErr != nil && err == nil {
+			err = fmt.Errorf("tags changed, but can't update open windows: %w", notifyErr)
+		}
+	}
+
+	return changes, err
+}
+
+// tagEach applies the tag changes to the messages matching each of the queries, using a single batch
+func tagEach(nm notmuch.Backend, tags []string, queries []string) error {
+	return tagQueries(nm, tags, queries, 0)
+}
+
+// tagEachUnrecorded is tagEach for automatic changes, which aren't recorded in the journal and can't be undone
+func tagEachUnrecorded(nm notmuch.Backend, tags []string, queries []string) error {
+	return tagQueries(nm, tags, queries, _unrecorded)
+}
+
+func tagQueries(nm notmuch.Backend, tags []string, queries []string, undoes int64) error {
+	err := notmuch.CheckTagOps(tags)
+	if err != nil {
+		return err
+	}
+
+	sets, err := messageTags(nm, queries)
+	if err != nil {
+		return err
+	}
+
+	var ops []messageTagOp
+	for _, set := range sets {
+		ops = append(ops, messageTagOp{Current: set, Tags: tags})
+	}
+
+	_, err = applyMessageTags(nm, ops, undoes)
+
+	return err
+}
+
+// notifyTagChanges publishes the IDs of the changed messages and their threads on the bus
+func notifyTagChanges(nm notmuch.Backend, changes []tagChange) error {
+	var e tagEvent
+
+	var queries []string
+	for _, c := range changes {
+		e.MessageIDs = append(e.MessageIDs, c.ID)
+		queries = append(queries, "id:"+c.ID)
+	}
+
+	seen := make(map[string]bool)
+
+	for _, query := range chunkQueries(queries) {
+		var threadIDs []string
+
+		err := decodeSearch(nm, query, notmuch.SearchOptions{Output: "threads", IncludeExcluded: true}, &threadIDs)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range threadIDs {
+			if !seen[id] {
+				seen[id] = true
+				e.ThreadIDs = append(e.ThreadIDs, id)
+			}
+		}
+	}
+
+	_bus.publish(e)
+
+	return nil
+}
+
+// undoGroup reverts the changes of a group from the journal. Only the tags that were changed are touched, other
+// tags that were changed since then are kept.
+func undoGroup(nm notmuch.Backend, group int64) error {
+	changes := _journal.changes(group)
+	if len(changes) == 0 {
+		return fmt.Errorf("no changes recorded for #%d", group)
+	}
+
+	var queries []string
+	for _, c := range changes {
+		queries = append(queries, "id:"+c.ID)
+	}
+
+	sets, err := messageTags(nm, queries)
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]TagSet)
+	for _, set := range sets {
+		current[set.MsgID] = set
+	}
+
+	var ops []messageTagOp
+	for _, c := range changes {
+		set, ok := current[c.ID]
+		if !ok {
+			// The message is gone
+			continue
+		}
+
+		ops = append(ops, messageTagOp{Current: set, Tags: c.reverse().ops()})
+	}
+
+	_, err = applyMessageTags(nm, ops, group)
+
+	return err
+}
+
+// undo reverts the last n groups of changes that haven't been undone yet
+func undo(nm notmuch.Backend, n int) error {
+	groups := _journal.undoable(n)
+	if len(groups) == 0 {
+		return errNothingToUndo
+	}
+
+	for _, g := range groups {
+		err := undoGroup(nm, g)
+		if err != nil {
+			return fmt.Errorf("undoing #%d: %w", g, err)
+		}
+	}
+
+	return nil
+}
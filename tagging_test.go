@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkQueries(t *testing.T) {
+	var queries []string
+	for i := 0; i < 2*_queryChunk+1; i++ {
+		queries = append(queries, "id:root@example.com")
+	}
+
+	chunks := chunkQueries(queries)
+	require.Len(t, chunks, 3)
+	assert.Equal(t, _queryChunk, strings.Count(chunks[0], "(id:root@example.com)"))
+	assert.Equal(t, "(id:root@example.com)", chunks[2])
+
+	sets, err := messageTags(loadTestFake(t), append(queries, "id:lunch@example.com"))
+	require.NoError(t, err)
+	assert.Len(t, sets, 2)
+}
@@ -1,41 +1,71 @@
 package main
 
 import (
+	"crypto/sha1"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/mail"
-	"os/exec"
-	"strconv"
 	"strings"
 	"sync"
+	"unicode/utf8"
 
 	"9fans.net/go/acme"
+
+	"github.com/farhaven/acme-notmuch/notmuch"
 )
 
-// IDMap is used to map message IDs to shorter identifier strings and back.
-// This structure and its methods are not goroutine safe.
+// IDMap maps message IDs to shorter identifier strings and back. The identifiers are derived from a hash of the
+// message ID, so that a message keeps its identifier when windows are refreshed. Longer parts of the hash are used if
+// the short one is taken already. It is safe for concurrent use.
 type IDMap struct {
 	Prefix string
-	Count  int
-	Vals   map[string]string
+
+	mu   sync.Mutex
+	vals map[string]string // identifier -> message ID
+	ids  map[string]string // message ID -> identifier
 }
 
+// _shortIDLen is the number of hex digits of the hash used in identifiers
+const _shortIDLen = 6
+
+// _messageIDs holds the identifiers of all messages shown in any window, so that they can be looked up everywhere
+var _messageIDs = &IDMap{Prefix: "msg_"}
+
 // Put places val in i and returns an identifier that can be used to get val back
 func (i *IDMap) Put(val string) string {
-	if i.Vals == nil {
-		i.Vals = make(map[string]string)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.vals == nil {
+		i.vals = make(map[string]string)
+		i.ids = make(map[string]string)
 	}
 
-	id := i.Prefix + strconv.Itoa(i.Count)
-	i.Count += 1
-	i.Vals[id] = val
+	if id, ok := i.ids[val]; ok {
+		return id
+	}
+
+	sum := fmt.Sprintf("%x", sha1.Sum([]byte(val)))
+
+	n := _shortIDLen
+	for n < len(sum) && i.vals[i.Prefix+sum[:n]] != "" {
+		n++
+	}
+
+	id := i.Prefix + sum[:n]
+	i.vals[id] = val
+	i.ids[val] = id
+
 	return id
 }
 
 // Get returns a previously allocated value from i
-func (i IDMap) Get(id string) (string, error) {
-	val, ok := i.Vals[id]
+func (i *IDMap) Get(id string) (string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	val, ok := i.vals[id]
 	if !ok {
 		return "", fmt.Errorf("no entry with ID %q", id)
 	}
@@ -48,82 +78,286 @@ type TagSet struct {
 	Tags  map[string]bool
 }
 
-type ThreadEntry interface {
-	// Tree renders a tread entry of the given level as a list of strings. It places message IDs in the given IDMap.
-	Tree(int, *IDMap) ([]string, error)
+// Node is a message in the reply tree of a thread. Message is nil for messages that notmuch omitted because they
+// don't match the query.
+type Node struct {
+	Message *ThreadMessage
+	Parent  *Node
+	Replies []*Node
 
-	// PreOrder returns a traversal of the thread entry in pre-order.
-	PreOrder() []TagSet
+	raw json.RawMessage // The message as notmuch printed it, including the body if it was requested
 }
 
-// A thread is a list of child threads or messages
-type Thread []ThreadEntry
+// Thread is the reply tree of a thread. Usually there is only one root message, but replies to messages that aren't
+// in the database are roots as well.
+type Thread []*Node
+
+// parseNodes decodes a list of [message, [replies]] pairs from the output of `notmuch show --format=json`
+func parseNodes(data json.RawMessage, parent *Node) ([]*Node, error) {
+	var pairs [][]json.RawMessage
 
-func (t Thread) Tree(indent int, m *IDMap) ([]string, error) {
-	var entries []string
+	err := json.Unmarshal(data, &pairs)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, e := range t {
-		child, err := e.Tree(indent+1, m)
+	var nodes []*Node
+
+	for _, pair := range pairs {
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("expected message and replies, got %d entries", len(pair))
+		}
+
+		n := &Node{Parent: parent}
+
+		if string(pair[0]) != "null" {
+			n.Message = &ThreadMessage{}
+			n.raw = pair[0]
+
+			err = json.Unmarshal(pair[0], n.Message)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		n.Replies, err = parseNodes(pair[1], n)
 		if err != nil {
 			return nil, err
 		}
 
-		entries = append(entries, child...)
+		nodes = append(nodes, n)
 	}
 
-	return entries, nil
+	return nodes, nil
 }
 
-func (t *Thread) UnmarshalJSON(data []byte) error {
-	// Decode as list of things that are either threads or messages
-	var (
-		raw     []json.RawMessage
-		decoded Thread
-	)
+// parseThreads decodes the output of `notmuch show --format=json`
+func parseThreads(data []byte) ([]Thread, error) {
+	var raw []json.RawMessage
 
 	err := json.Unmarshal(data, &raw)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, rawEntry := range raw {
-		// Decode the raw message either as a ThreadMessage or as a whole thread
-		// Let's try the message first
-		var (
-			entry ThreadEntry
-			tm    ThreadMessage
-		)
+	var threads []Thread
 
-		err = json.Unmarshal(rawEntry, &tm)
+	for _, r := range raw {
+		roots, err := parseNodes(r, nil)
 		if err != nil {
-			// Can't unmarshal as raw message, let's try the thread
-			var te Thread
-			err = json.Unmarshal(rawEntry, &te)
+			return nil, err
+		}
+
+		threads = append(threads, roots)
+	}
+
+	return threads, nil
+}
+
+// loadThread returns the complete reply tree of the thread with the given ID. If query isn't empty, only the
+// messages matching it are marked as matches. Should none of them match anymore, all of them are.
+func loadThread(nm notmuch.Backend, threadID, query string) (Thread, error) {
+	q := "thread:" + threadID
+	if query != "" {
+		q += " and (" + query + ")"
+	}
+
+	output, err := nm.Show(q, notmuch.ShowOptions{EntireThread: true})
+	if err != nil {
+		return nil, fmt.Errorf("getting output from notmuch: %w", err)
+	}
+
+	threads, err := parseThreads(output)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshaling thread %s: %w", threadID, err)
+	}
+
+	if len(threads) == 0 && query != "" {
+		return loadThread(nm, threadID, "")
+	}
+
+	if len(threads) != 1 {
+		return nil, fmt.Errorf("expected one thread %s, got %d", threadID, len(threads))
+	}
+
+	return threads[0], nil
+}
+
+// walk calls f for n and all of its replies, in pre-order
+func (n *Node) walk(f func(*Node)) {
+	f(n)
+
+	for _, r := range n.Replies {
+		r.walk(f)
+	}
+}
+
+// FirstChild returns the first reply to n, or nil if there is none
+func (n *Node) FirstChild() *Node {
+	if len(n.Replies) == 0 {
+		return nil
+	}
+
+	return n.Replies[0]
+}
+
+// Depth returns the number of ancestors of n
+func (n *Node) Depth() int {
+	depth := 0
+	for p := n.Parent; p != nil; p = p.Parent {
+		depth++
+	}
+
+	return depth
+}
+
+// PreOrder returns all nodes of t in pre-order
+func (t Thread) PreOrder() []*Node {
+	var nodes []*Node
+
+	for _, root := range t {
+		root.walk(func(n *Node) {
+			nodes = append(nodes, n)
+		})
+	}
+
+	return nodes
+}
+
+// Find returns the node of the message with the given ID, or nil if it isn't part of t
+func (t Thread) Find(messageID string) *Node {
+	for _, n := range t.PreOrder() {
+		if n.Message != nil && n.Message.ID == messageID {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// siblings returns the list of nodes that n is part of: the replies to its parent, or the roots of t
+func (t Thread) siblings(n *Node) []*Node {
+	if n.Parent != nil {
+		return n.Parent.Replies
+	}
+
+	return t
+}
+
+// sibling returns the node offset places away from n among its siblings, or nil if there is none
+func (t Thread) sibling(n *Node, offset int) *Node {
+	siblings := t.siblings(n)
+
+	for idx, s := range siblings {
+		if s != n {
+			continue
+		}
+
+		if idx+offset < 0 || idx+offset >= len(siblings) {
+			return nil
+		}
+
+		return siblings[idx+offset]
+	}
+
+	return nil
+}
+
+// NextSibling returns the next reply to the parent of n, or nil if n is the last one
+func (t Thread) NextSibling(n *Node) *Node {
+	return t.sibling(n, 1)
+}
+
+// PrevSibling returns the previous reply to the parent of n, or nil if n is the first one
+func (t Thread) PrevSibling(n *Node) *Node {
+	return t.sibling(n, -1)
+}
+
+// Tree renders t as one line per message, with the reply structure drawn in front of the subjects. The replies to
+// messages in folded are replaced by a summary line. It places message IDs in the given IDMap.
+func (t Thread) Tree(m *IDMap, folded map[string]bool) ([]string, error) {
+	var (
+		lines  []string
+		render func(nodes []*Node, indent string, top bool) error
+	)
+
+	render = func(nodes []*Node, indent string, top bool) error {
+		for idx, n := range nodes {
+			connector, childIndent := "├─ ", indent+"│  "
+			if idx == len(nodes)-1 {
+				connector, childIndent = "└─ ", indent+"   "
+			}
+
+			if top {
+				connector, childIndent = "", ""
+			}
+
+			if n.Message != nil {
+				line, err := n.Message.Line(indent+connector, m)
+				if err != nil {
+					return err
+				}
+
+				lines = append(lines, line)
+
+				if folded[n.Message.ID] && len(n.Replies) != 0 {
+					hidden, unread := n.countReplies()
+					lines = append(lines, summaryLine(childIndent+"└─ ", fmt.Sprintf("[%d hidden, %d unread]", hidden, unread)))
+
+					continue
+				}
+			}
+
+			err := render(n.Replies, childIndent, false)
 			if err != nil {
 				return err
 			}
-			entry = te
-		} else {
-			entry = tm
 		}
 
-		decoded = append(decoded, entry)
+		return nil
 	}
 
-	*t = decoded
+	err := render(t, "", true)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	return lines, nil
 }
 
-// PreOrder flattens t to pre-order traversal, returning a list of message IDs and tags
-func (t Thread) PreOrder() []TagSet {
-	var ret []TagSet
+// summaryLine renders text in the subject column of thread windows, after the given tree. The other columns are
+// empty.
+func summaryLine(tree, text string) string {
+	var cols []string
 
-	for _, entry := range t {
-		ret = append(ret, entry.PreOrder()...)
+	for _, col := range _config.Thread.Columns {
+		if col == "subject" {
+			break
+		}
+
+		cols = append(cols, "")
 	}
 
-	return ret
+	return strings.Join(append(cols, tree+text), "\t")
+}
+
+// countReplies returns the number of all direct and indirect replies to n, and how many of them are unread
+func (n *Node) countReplies() (int, int) {
+	var total, unread int
+
+	n.walk(func(r *Node) {
+		if r == n || r.Message == nil {
+			return
+		}
+
+		total++
+
+		if r.Message.TagSet().Tags["unread"] {
+			unread++
+		}
+	})
+
+	return total, unread
 }
 
 type ThreadMessage struct {
@@ -137,126 +371,271 @@ type ThreadMessage struct {
 	Headers      map[string]string
 }
 
-func (t ThreadMessage) Tree(indent int, m *IDMap) ([]string, error) {
-	subject := t.Headers["Subject"]
-	if len(subject) > _maxSubjectLen {
-		subject = subject[:_maxSubjectLen] + "..."
-	}
+// Flags returns the indicators shown in the flags column of thread windows
+func (t ThreadMessage) Flags() string {
+	var flags strings.Builder
 
-	is := strings.Repeat(" ", indent)
+	if t.Match {
+		flags.WriteString("*")
+	}
 
-	id := m.Put(t.ID)
+	if t.Excluded {
+		flags.WriteString("x")
+	}
 
-	mailFrom := t.Headers["From"]
-	fromAddr, err := mail.ParseAddress(mailFrom)
-	if err != nil {
-		return nil, fmt.Errorf("can't parse From header %q: %w", mailFrom, err)
-	} else {
-		if fromAddr.Name != "" {
-			mailFrom = fromAddr.Name
-		} else {
-			mailFrom = fromAddr.Address
+	// notmuch tags messages with attachments, signatures and encrypted parts when it indexes them
+	tags := t.TagSet().Tags
+	for _, f := range []struct {
+		tag, flag string
+	}{
+		{"attachment", "A"},
+		{"signed", "S"},
+		{"encrypted", "E"},
+	} {
+		if tags[f.tag] {
+			flags.WriteString(f.flag)
 		}
 	}
 
-	res := []string{
-		id + "\t" + is + subject + "\t" + "(" + mailFrom + ")\t" + fmt.Sprintf("%v", t.Tags),
+	return flags.String()
+}
+
+// Line renders t as a line of the thread window, with the columns from the configuration. The tree is drawn in
+// front of the subject.
+func (t ThreadMessage) Line(tree string, m *IDMap) (string, error) {
+	var cols []string
+
+	for _, col := range _config.Thread.Columns {
+		switch col {
+		case "id":
+			cols = append(cols, m.Put(t.ID))
+		case "flags":
+			flags := t.Flags()
+			if _windows.isOpen("message", t.ID) {
+				flags += "o"
+			}
+
+			cols = append(cols, flags)
+		case "date":
+			cols = append(cols, t.DateRelative)
+		case "subject":
+			subject := t.Headers["Subject"]
+			if len(subject) > _config.Query.MaxSubjectLen {
+				subject = subject[:_config.Query.MaxSubjectLen] + "..."
+			}
+
+			cols = append(cols, tree+subject)
+		case "from":
+			mailFrom := t.Headers["From"]
+			fromAddr, err := mail.ParseAddress(mailFrom)
+			if err != nil {
+				return "", fmt.Errorf("can't parse From header %q: %w", mailFrom, err)
+			} else {
+				if fromAddr.Name != "" {
+					mailFrom = fromAddr.Name
+				} else {
+					mailFrom = fromAddr.Address
+				}
+			}
+
+			cols = append(cols, "("+mailFrom+")")
+		case "tags":
+			cols = append(cols, fmt.Sprintf("%v", t.Tags))
+		}
 	}
 
-	return res, nil
+	return strings.Join(cols, "\t"), nil
 }
 
-func (t ThreadMessage) PreOrder() []TagSet {
+// TagSet returns the ID and tags of t
+func (t ThreadMessage) TagSet() TagSet {
 	tags := make(map[string]bool)
 
 	for _, tag := range t.Tags {
 		tags[tag] = true
 	}
 
-	return []TagSet{
-		{MsgID: t.ID, Tags: tags},
-	}
+	return TagSet{MsgID: t.ID, Tags: tags}
 }
 
-func refreshThread(win *acme.Win, threadID string) (IDMap, error) {
-	err := win.Fprintf("data", "Looking for thread %s", threadID)
+// renderThread returns the lines of the thread window for the thread with the given ID. Messages matching query are
+// marked, the replies to the messages in folded are hidden.
+func renderThread(nm notmuch.Backend, threadID, query string, folded map[string]bool) ([]string, error) {
+	thread, err := loadThread(nm, threadID, query)
 	if err != nil {
-		return IDMap{}, err
+		return nil, err
 	}
 
-	cmd := exec.Command("notmuch", "show", "--body=false", "--format=json", "thread:"+threadID)
-
-	output, err := cmd.CombinedOutput()
+	entries, err := thread.Tree(_messageIDs, folded)
 	if err != nil {
-		return IDMap{}, fmt.Errorf("getting output from notmuch: %w", err)
+		return nil, fmt.Errorf("rendering thread %s: %w", threadID, err)
 	}
 
-	var thread Thread
+	return entries, nil
+}
+
+// reloadThread updates the thread window without clearing it, so that dot and the scroll position are kept. If
+// the window was edited, it is left alone.
+func reloadThread(win *acme.Win, nm notmuch.Backend, threadID, query string, folded map[string]bool) error {
+	dirty, err := isDirty(win)
+	if err != nil || dirty {
+		return err
+	}
 
-	err = json.Unmarshal(output, &thread)
+	entries, err := renderThread(nm, threadID, query, folded)
 	if err != nil {
-		return IDMap{}, fmt.Errorf("unmarshaling thread %s: %w", threadID, err)
+		return err
 	}
 
-	win.Clear()
+	return replaceBody(win, formatTabbed(win, strings.Join(entries, "\n")))
+}
 
-	idMap := IDMap{Prefix: "msg_"}
+func refreshThread(win *acme.Win, nm notmuch.Backend, threadID, query string, folded map[string]bool) error {
+	err := win.Fprintf("data", "Looking for thread %s", threadID)
+	if err != nil {
+		return err
+	}
 
-	entries, err := thread.Tree(0, &idMap)
+	entries, err := renderThread(nm, threadID, query, folded)
 	if err != nil {
-		return IDMap{}, fmt.Errorf("rendering thread %s: %w", threadID, err)
+		win.Fprintf("data", "\n%s\n", describeError(err))
+		winClean(win)
+
+		return err
 	}
 
+	win.Clear()
+
 	// longestcommon.TrimPrefix(entries)
 	win.PrintTabbed(strings.Join(entries, "\n"))
 
 	err = winClean(win)
 	if err != nil {
-		return IDMap{}, fmt.Errorf("cleaning window state: %w", err)
+		return fmt.Errorf("cleaning window state: %w", err)
+	}
+
+	return nil
+}
+
+// selectedMessages returns the IDs of the messages on the selected lines of win
+func selectedMessages(win *acme.Win) ([]string, error) {
+	lines, err := selectedLines(win)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+
+	for _, line := range lines {
+		for _, field := range strings.Fields(line) {
+			id, err := _messageIDs.Get(field)
+			if err == nil {
+				res = append(res, id)
+				break
+			}
+		}
+	}
+
+	if len(res) == 0 {
+		return nil, errors.New("no message selected")
+	}
+
+	return res, nil
+}
+
+// showMessageLine sets dot on the line of the message with the given ID
+func showMessageLine(win *acme.Win, messageID string) error {
+	body, err := win.ReadAll("body")
+	if err != nil {
+		return err
 	}
 
-	return idMap, nil
+	id := _messageIDs.Put(messageID)
+	offset := 0
+
+	for _, line := range strings.SplitAfter(string(body), "\n") {
+		length := utf8.RuneCountInString(line)
+
+		for _, field := range strings.Fields(line) {
+			if field != id {
+				continue
+			}
+
+			return setDot(win, offset, offset+length)
+		}
+
+		offset += length
+	}
+
+	return errors.New("message not found in thread window")
 }
 
 var errNoMessage = errors.New("no such message")
 
 // Handle 'look' command or event with given text. Returns an error if the given text does not match a
 // message ID and the event that this look was called for should be sent back to Acme
-func look(wg *sync.WaitGroup, win *acme.Win, ids IDMap, text string) error {
+func look(wg *sync.WaitGroup, nm notmuch.Backend, text, origin string) error {
 	id := strings.Trim(text, " \r\t\n")
 
-	if !strings.HasPrefix(id, ids.Prefix) {
+	if !strings.HasPrefix(id, _messageIDs.Prefix) {
 		return errNoMessage
 	}
 
 	// Get message ID. If we don't have any, push the event back to ACME
-	id, err := ids.Get(id)
+	id, err := _messageIDs.Get(id)
 	if err != nil {
 		return errNoMessage
 	}
 
 	wg.Add(1)
 	// Open thread in new window
-	go displayMessage(wg, string(id))
+	go displayMessage(wg, nm, string(id), origin)
 
 	return nil
 }
 
-func displayThread(wg *sync.WaitGroup, threadID string) {
+// displayThread shows the thread with the given ID. If it was opened from a query window, origin is the window's
+// query, so that the matching messages can be marked. If focus isn't empty, dot is set on the line of the message with
+// that ID.
+func displayThread(wg *sync.WaitGroup, nm notmuch.Backend, threadID, origin, focus string) {
 	defer wg.Done()
 
-	win, err := newWin("/Mail/thread/"+threadID, "Get")
+	_, query := parseQuery(origin)
+
+	reg := _windows.open("thread", threadID)
+	if reg == nil {
+		// Already open
+		if focus != "" {
+			_bus.publish(focusEvent{ThreadID: threadID, MessageID: focus})
+		}
+
+		return
+	}
+	defer _windows.close(reg)
+
+	win, err := newWin("/Mail/thread/"+threadID, "Get Fold Unfold Conversation Read Archive Delete")
 	if err != nil {
 		win.Errf("can't open thread display window for %s: %s", threadID, err)
 		return
 	}
 
-	idMap, err := refreshThread(win, threadID)
+	nm = warnTo(nm, win)
+
+	folded := make(map[string]bool)
+
+	err = refreshThread(win, nm, threadID, query, folded)
 	if err != nil {
 		win.Errf("can't refresh thread display for %s: %s", threadID, err)
 		return
 	}
 
+	if focus != "" {
+		err = showMessageLine(win, focus)
+		if err != nil {
+			win.Errf("can't show message %s: %s", focus, err)
+		}
+	}
+
 	// Events:
 	// - l/L:
 	//   - look up message with id in evt.Text
@@ -266,7 +645,70 @@ func displayThread(wg *sync.WaitGroup, threadID string) {
 	//   - or run regular Acme Look command if not on message ID
 	// - Get: refresh thread view
 
-	for evt := range win.EventChan() {
+	sub := _bus.subscribe()
+	defer _bus.cancel(sub)
+
+	events := win.EventChan()
+
+	for {
+		var evt *acme.Event
+
+		select {
+		case e := <-sub.C:
+			switch e := e.(type) {
+			case tagEvent:
+				if !e.hasThread(threadID) {
+					continue
+				}
+			case messageWindowEvent:
+				if e.ThreadID != threadID {
+					continue
+				}
+			case focusEvent:
+				if e.ThreadID != threadID {
+					continue
+				}
+
+				err = win.Ctl("show")
+				if err == nil {
+					err = showMessageLine(win, e.MessageID)
+				}
+
+				if err != nil {
+					win.Errf("can't show message %s: %s", e.MessageID, err)
+				}
+
+				continue
+			case dbChanged:
+			default:
+				continue
+			}
+
+			err = reloadThread(win, nm, threadID, query, folded)
+			if err != nil {
+				win.Errf("can't update thread display for %s: %s", threadID, err)
+			}
+
+			continue
+		case <-reg.Raise:
+			err = win.Ctl("show")
+			if err == nil {
+				err = reloadThread(win, nm, threadID, query, folded)
+			}
+
+			if err != nil {
+				win.Errf("can't update thread display for %s: %s", threadID, err)
+			}
+
+			continue
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+
+			evt = ev
+		}
+
 		var (
 			doLook   bool
 			lookText string
@@ -276,10 +718,67 @@ func displayThread(wg *sync.WaitGroup, threadID string) {
 		case 'x', 'X':
 			switch string(evt.Text) {
 			case "Get":
-				idMap, err = refreshThread(win, threadID)
+				err = refreshThread(win, nm, threadID, query, folded)
 				if err != nil {
 					win.Errf("can't refresh thread display for %s: %s", threadID, err)
 				}
+				continue
+			case "Fold", "Unfold":
+				ids, err := selectedMessages(win)
+				if err == nil {
+					for _, id := range ids {
+						if string(evt.Text) == "Fold" {
+							folded[id] = true
+						} else {
+							delete(folded, id)
+						}
+					}
+
+					err = reloadThread(win, nm, threadID, query, folded)
+				}
+
+				if err != nil {
+					win.Errf("can't %s thread display for %s: %s", strings.ToLower(string(evt.Text)), threadID, err)
+				}
+
+				continue
+			case "Conversation":
+				wg.Add(1)
+				go displayConversation(wg, nm, threadID)
+
+				continue
+			case "Delete", "Archive":
+				action := _config.Delete
+				if string(evt.Text) == "Archive" {
+					action = _config.Archive
+				}
+
+				err := tagEach(nm, action.Tags, []string{"thread:" + threadID})
+				if err != nil {
+					win.Errf("can't change tags of thread %s: %s", threadID, err)
+				}
+
+				continue
+			case "Spam", "Ham":
+				err := markSpam(nm, []string{"thread:" + threadID}, string(evt.Text) == "Spam")
+				if err != nil {
+					win.Errf("can't mark thread %s as %s: %s", threadID, strings.ToLower(string(evt.Text)), err)
+				}
+
+				continue
+			case "Read":
+				err := tagEach(nm, []string{"-unread"}, []string{"thread:" + threadID})
+				if err != nil {
+					win.Errf("can't mark thread %s as read: %s", threadID, err)
+				}
+
+				continue
+			case "Mute", "Unmute":
+				err := muteThread(nm, threadID, string(evt.Text) == "Mute")
+				if err != nil {
+					win.Errf("can't %s thread %s: %s", strings.ToLower(string(evt.Text)), threadID, err)
+				}
+
 				continue
 			case "Look":
 				doLook = true
@@ -306,12 +805,20 @@ func displayThread(wg *sync.WaitGroup, threadID string) {
 					lookText = win.Selection()
 				}
 			default:
-				// Let ACME handle the event
-				err := win.WriteEvent(evt)
-				if err != nil {
-					win.Errf("can't write event: %s", err)
-					return
+				err := handleCommand(wg, nm, win, evt)
+				switch err {
+				case nil:
+					// Nothing to do, event already handled
+				case errNotACommand:
+					// Let ACME handle the event
+					err := win.WriteEvent(evt)
+					if err != nil {
+						win.Errf("can't write event: %s", err)
+						return
+					}
 				}
+
+				continue
 			}
 		case 'l', 'L':
 			doLook = true
@@ -324,7 +831,7 @@ func displayThread(wg *sync.WaitGroup, threadID string) {
 			continue
 		}
 
-		err := look(wg, win, idMap, lookText)
+		err := look(wg, nm, lookText, origin)
 		switch err {
 		case nil:
 		case errNoMessage:
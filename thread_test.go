@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/farhaven/acme-notmuch/notmuch"
+)
+
+func TestThread_Navigation(t *testing.T) {
+	fake := loadTestFake(t)
+
+	threadID, err := threadOf(fake, "reply1@example.com")
+	require.NoError(t, err)
+
+	thread, err := loadThread(fake, threadID, "")
+	require.NoError(t, err)
+
+	var ids []string
+	for _, n := range thread.PreOrder() {
+		ids = append(ids, n.Message.ID)
+	}
+
+	assert.Equal(t, []string{"root@example.com", "reply1@example.com", "reply2@example.com", "reply3@example.com"}, ids)
+
+	root := thread.Find("root@example.com")
+	require.NotNil(t, root)
+	assert.Nil(t, root.Parent)
+	assert.Nil(t, thread.NextSibling(root))
+	assert.Equal(t, "reply1@example.com", root.FirstChild().Message.ID)
+
+	reply1 := thread.Find("reply1@example.com")
+	assert.Equal(t, root, reply1.Parent)
+	assert.Equal(t, "reply3@example.com", thread.NextSibling(reply1).Message.ID)
+	assert.Nil(t, thread.PrevSibling(reply1))
+
+	reply2 := thread.Find("reply2@example.com")
+	assert.Equal(t, 2, reply2.Depth())
+	assert.Nil(t, reply2.FirstChild())
+
+	assert.Equal(t, reply1, thread.PrevSibling(thread.Find("reply3@example.com")))
+	assert.Nil(t, thread.Find("lunch@example.com"))
+}
+
+func TestThread_Tree(t *testing.T) {
+	fake := loadTestFake(t)
+
+	thread, err := loadThread(fake, "0000000000000001", "")
+	require.NoError(t, err)
+
+	var subjects []string
+
+	lines, err := thread.Tree(&IDMap{Prefix: "msg_"}, nil)
+	require.NoError(t, err)
+
+	for _, l := range lines {
+		subjects = append(subjects, strings.Split(l, "\t")[3])
+	}
+
+	assert.Equal(t, []string{"Stapler", "├─ Re: Stapler", "│  └─ Re: Stapler", "└─ Re: Stapler"}, subjects)
+
+	lines, err = thread.Tree(&IDMap{Prefix: "msg_"}, map[string]bool{"root@example.com": true})
+	require.NoError(t, err)
+	require.Len(t, lines, 2)
+	assert.Equal(t, "\t\t\t└─ [3 hidden, 3 unread]", lines[1])
+}
+
+func TestThreadMessage_Line(t *testing.T) {
+	defer func(c config) { _config = c }(_config)
+
+	msg := ThreadMessage{
+		ID:           "foo@example.com",
+		Match:        true,
+		DateRelative: "Today 12:34",
+		Tags:         []string{"attachment", "signed", "unread"},
+		Headers:      map[string]string{"Subject": "Hello", "From": "Alice <alice@example.com>"},
+	}
+
+	line, err := msg.Line("└─ ", &IDMap{Prefix: "msg_"})
+	require.NoError(t, err)
+	assert.Equal(t, "msg_767e74\t*AS\tToday 12:34\t└─ Hello\t(Alice)\t[attachment signed unread]", line)
+
+	_config.Thread.Columns = []string{"date", "id", "subject"}
+
+	line, err = msg.Line("", &IDMap{Prefix: "msg_"})
+	require.NoError(t, err)
+	assert.Equal(t, "Today 12:34\tmsg_767e74\tHello", line)
+}
+
+func TestIDMap(t *testing.T) {
+	var m IDMap
+	m.Prefix = "msg_"
+
+	id := m.Put("foo@example.com")
+	assert.Equal(t, "msg_767e74", id)
+	assert.Equal(t, id, m.Put("foo@example.com"))
+
+	val, err := m.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, "foo@example.com", val)
+
+	// Another message whose hash starts with the same digits gets a longer identifier
+	m.vals = map[string]string{"msg_1ac2c5": "other@example.com"}
+	m.ids = map[string]string{"other@example.com": "msg_1ac2c5"}
+
+	assert.Equal(t, "msg_1ac2c5a", m.Put("bar@example.com"))
+
+	_, err = m.Get("msg_123456")
+	assert.Error(t, err)
+}
+
+func TestNextMessage(t *testing.T) {
+	fake := loadTestFake(t)
+
+	next, err := nextMessage(fake, "root@example.com", "", true, true)
+	require.NoError(t, err)
+	assert.Equal(t, "reply1@example.com", next)
+
+	next, err = nextMessage(fake, "reply3@example.com", "", false, false)
+	require.NoError(t, err)
+	assert.Equal(t, "reply2@example.com", next)
+
+	_, err = nextMessage(fake, "reply1@example.com", "", false, true)
+	assert.EqualError(t, err, "no previous message found")
+
+	// Continue in the next thread of the query, even though the current one doesn't match anymore
+	next, err = nextMessage(fake, "reply3@example.com", "tag:attachment", true, true)
+	require.NoError(t, err)
+	assert.Equal(t, "lunch@example.com", next)
+
+	next, err = nextMessage(fake, "lunch@example.com", "-oldest tag:inbox", true, false)
+	require.NoError(t, err)
+	assert.Equal(t, "root@example.com", next)
+
+	// Going back ends up at the last message of the previous thread
+	next, err = nextMessage(fake, "root@example.com", "-oldest tag:inbox", false, false)
+	require.NoError(t, err)
+	assert.Equal(t, "lunch@example.com", next)
+
+	_, err = nextMessage(fake, "lunch@example.com", "-oldest tag:inbox", false, false)
+	assert.EqualError(t, err, "no previous message found")
+}
+
+// failingSearch is a backend whose search results report an error when they are closed, like notmuch exiting
+// with an error after printing them
+type failingSearch struct {
+	notmuch.Backend
+}
+
+func (f failingSearch) Search(query string, opts notmuch.SearchOptions) (io.ReadCloser, error) {
+	r, err := f.Backend.Search(query, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return failingCloser{r}, nil
+}
+
+type failingCloser struct {
+	io.Reader
+}
+
+func (failingCloser) Close() error {
+	return errors.New("notmuch failed")
+}
+
+func TestThreadsAroundCloseError(t *testing.T) {
+	_, err := threadsAround(failingSearch{loadTestFake(t)}, "tag:inbox", notmuch.SearchOptions{},
+		"0000000000000001", true, false)
+	assert.EqualError(t, err, "notmuch failed")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"time"
+
+	"9fans.net/go/acme"
+
+	"github.com/farhaven/acme-notmuch/notmuch"
+)
+
+// watchDatabase polls the database revision and publishes dbChanged on the bus whenever it changes. New messages in
+// muted threads are handled before that, so that windows don't show them as unread.
+func watchDatabase(nm notmuch.Backend, interval time.Duration) {
+	last, err := nm.Revision()
+	if err != nil {
+		log.Printf("can't watch database: %s", describeError(err))
+		return
+	}
+
+	for range time.Tick(interval) {
+		rev, err := nm.Revision()
+		if err != nil {
+			// Probably locked by notmuch new, try again later
+			continue
+		}
+
+		if rev == last {
+			continue
+		}
+
+		err = stripMuted(nm)
+		if err != nil {
+			log.Printf("can't update muted threads: %s", describeError(err))
+		}
+
+		// Pick up the changes made by stripMuted as well, so that they don't cause another round of updates
+		rev, err = nm.Revision()
+		if err != nil {
+			continue
+		}
+
+		last = rev
+
+		_bus.publish(dbChanged{})
+	}
+}
+
+// isDirty returns true if the body of win was modified since it was last marked clean
+func isDirty(win *acme.Win) (bool, error) {
+	ctl, err := win.ReadAll("ctl")
+	if err != nil {
+		return false, err
+	}
+
+	// ID, tag length, body length, directory flag, dirty flag, ...
+	fields := strings.Fields(string(ctl))
+
+	return len(fields) > 4 && fields[4] == "1", nil
+}
+
+// formatTabbed aligns the columns of text like win.PrintTabbed, but returns the result instead of writing it to
+// the body
+func formatTabbed(win *acme.Win, text string) string {
+	tab, font, _ := win.Font()
+
+	var rows [][]string
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line == "" {
+			continue
+		}
+
+		rows = append(rows, strings.Split(strings.TrimSuffix(line, "\n"), "\t"))
+	}
+
+	var buf bytes.Buffer
+
+	for len(rows) > 0 {
+		if len(rows[0]) <= 1 {
+			buf.WriteString(rows[0][0] + "\n")
+			rows = rows[1:]
+
+			continue
+		}
+
+		// Align a block of consecutive lines with columns
+		n := 0
+		for n < len(rows) && len(rows[n]) > 1 {
+			n++
+		}
+
+		block := rows[:n]
+		rows = rows[n:]
+
+		var width []int
+		if font != nil {
+			for _, row := range block {
+				for len(width) < len(row) {
+					width = append(width, 0)
+				}
+
+				for idx, col := range row {
+					if w := font.StringWidth(col); w > width[idx] {
+						width[idx] = w
+					}
+				}
+			}
+		}
+
+		for _, row := range block {
+			for idx, col := range row {
+				buf.WriteString(col)
+
+				if idx == len(row)-1 {
+					break
+				}
+
+				if font == nil || tab == 0 {
+					buf.WriteString("\t")
+					continue
+				}
+
+				for pos := font.StringWidth(col); pos <= width[idx]; pos += tab - pos%tab {
+					buf.WriteString("\t")
+				}
+			}
+
+			buf.WriteString("\n")
+		}
+	}
+
+	return buf.String()
+}
+
+// replaceBody changes the body of win to text. Only the part that differs from the current body is written, so
+// that acme keeps dot and the scroll position where they were.
+func replaceBody(win *acme.Win, text string) error {
+	body, err := win.ReadAll("body")
+	if err != nil {
+		return err
+	}
+
+	old := []rune(string(body))
+	repl := []rune(text)
+
+	prefix := 0
+	for prefix < len(old) && prefix < len(repl) && old[prefix] == repl[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(repl)-prefix &&
+		old[len(old)-1-suffix] == repl[len(repl)-1-suffix] {
+		suffix++
+	}
+
+	if prefix == len(old) && prefix == len(repl) {
+		// Nothing changed
+		return nil
+	}
+
+	err = win.Addr("#%d,#%d", prefix, len(old)-suffix)
+	if err != nil {
+		return err
+	}
+
+	_, err = win.Write("data", []byte(string(repl[prefix:len(repl)-suffix])))
+	if err != nil {
+		return err
+	}
+
+	return win.Ctl("clean")
+}